@@ -1,10 +1,17 @@
 package constants
 
 const (
-	GCIntervalSeconds       = 60
-	ClientTableName         = "oauth2_clients"
-	TokenTableName          = "oauth2_tokens"
-	ClientMetadataTableName = "client_meta_data"
-	ClientIdLength          = 10
-	ClientSecretLength      = 20
+	GCIntervalSeconds        = 60
+	ClientTableName          = "oauth2_clients"
+	TokenTableName           = "oauth2_tokens"
+	ClientMetadataTableName  = "client_meta_data"
+	ClientUsageTableName     = "client_usages"
+	StreamTicketTableName    = "stream_tickets"
+	IdempotencyKeyTableName  = "idempotency_keys"
+	WebhookEndpointTableName = "webhook_endpoints"
+	WebhookDeliveryTableName = "webhook_deliveries"
+	ClientIdLength           = 10
+	ClientSecretLength       = 20
+	ClientCacheSeconds       = 60
+	StreamTicketSeconds      = 30
 )
@@ -8,11 +8,11 @@ import (
 	"net/url"
 	"oauth2server/constants"
 	"oauth2server/models"
+	"oauth2server/problem"
 	"oauth2server/service"
 	"strings"
 
 	mdls "github.com/go-oauth2/oauth2/v4/models"
-	"github.com/go-playground/validator/v10"
 	"gorm.io/gorm"
 
 	oauth2gorm "github.com/getAlby/go-oauth2-gorm"
@@ -34,6 +34,12 @@ type OAuthController struct {
 	Service *service.Service
 }
 
+var (
+	errClientNotFound       = problem.New(http.StatusNotFound, problem.CodeClientNotFound, "Client not found.")
+	errInvalidClientRequest = problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Could not parse client request.")
+	errUserUnauthorized     = problem.New(http.StatusUnauthorized, problem.CodeUnauthorized, "Could not authenticate user, login or password missing or wrong.")
+)
+
 func (ctrl *OAuthController) AuthorizationHandler(w http.ResponseWriter, r *http.Request) {
 	err := ctrl.Service.OauthServer.HandleAuthorizeRequest(w, r)
 	if err != nil {
@@ -42,9 +48,43 @@ func (ctrl *OAuthController) AuthorizationHandler(w http.ResponseWriter, r *http
 	}
 }
 
+// catalogHost returns the host whose scopes and endpoints are shown,
+// the host query parameter or the host of the request.
+func catalogHost(r *http.Request) string {
+	if host := r.URL.Query().Get("host"); host != "" {
+		return strings.ToLower(host)
+	}
+	return service.RequestHost(r)
+}
+
+// baseURL returns the url of this server as the client sees it.
+// Hosts with targets of their own are their own issuer, other hosts use PUBLIC_URL.
+// The Host header is only used if it is one of the hosts of the targets, so clients can't choose the url.
+func (ctrl *OAuthController) baseURL(r *http.Request) string {
+	publicURL := strings.TrimSuffix(ctrl.Service.Config.PublicURL, "/")
+	host := service.RequestHost(r)
+	if ctrl.Service.IsTargetHost(host) {
+		scheme := ctrl.Service.RequestScheme(r)
+		if parsed, err := url.Parse(publicURL); publicURL != "" && err == nil && parsed.Scheme != "" {
+			scheme = parsed.Scheme
+		}
+		return fmt.Sprintf("%s://%s", scheme, host)
+	}
+	if publicURL != "" {
+		return publicURL
+	}
+	return fmt.Sprintf("http://localhost:%d", ctrl.Service.Config.Port)
+}
+
+// ScopeHandler returns the scopes of the host, or with a scope query parameter the scopes it grants,
+// including the implied scopes and the scopes matching wildcards, to show them on the consent screen.
 func (ctrl *OAuthController) ScopeHandler(w http.ResponseWriter, r *http.Request) {
+	scopes := ctrl.Service.HostScopes(catalogHost(r))
+	if requested := r.URL.Query().Get("scope"); requested != "" {
+		scopes = ctrl.Service.ExpandScopes(requested)
+	}
 	w.Header().Add("Content-type", "application/json")
-	err := json.NewEncoder(w).Encode(ctrl.Service.Scopes)
+	err := json.NewEncoder(w).Encode(scopes)
 	if err != nil {
 		logrus.Error(err)
 	}
@@ -52,10 +92,20 @@ func (ctrl *OAuthController) ScopeHandler(w http.ResponseWriter, r *http.Request
 
 func (ctrl *OAuthController) EndpointHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Content-type", "application/json")
-	endpoints := ctrl.Service.Endpoints
-	//not needed for clients
-	for _, e := range endpoints {
-		e.Origin = ""
+	endpoints := []service.OriginServer{}
+	for _, e := range ctrl.Service.HostEndpoints(catalogHost(r)) {
+		//copy, the endpoints are shared with the gateway
+		endpoint := *e
+		//not needed for clients
+		endpoint.Origin = ""
+		endpoint.Origins = nil
+		endpoint.LoadBalancing = ""
+		endpoint.ShadowOrigin = ""
+		endpoint.ShadowSampleRate = nil
+		endpoint.Headers = nil
+		//names of secrets and key files should not be public
+		endpoint.Credentials = nil
+		endpoints = append(endpoints, endpoint)
 	}
 	err := json.NewEncoder(w).Encode(endpoints)
 	if err != nil {
@@ -63,6 +113,26 @@ func (ctrl *OAuthController) EndpointHandler(w http.ResponseWriter, r *http.Requ
 	}
 }
 
+func (ctrl *OAuthController) OpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-type", "application/json")
+	//the document is public, so it can be loaded by API explorers on other sites
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	err := json.NewEncoder(w).Encode(ctrl.Service.OpenAPIDocument(ctrl.baseURL(r), service.RequestHost(r)))
+	if err != nil {
+		logrus.Error(err)
+	}
+}
+
+// DiscoveryHandler returns the authorization server metadata of RFC 8414.
+func (ctrl *OAuthController) DiscoveryHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	err := json.NewEncoder(w).Encode(ctrl.Service.DiscoveryMetadata(ctrl.baseURL(r), service.RequestHost(r)))
+	if err != nil {
+		logrus.Error(err)
+	}
+}
+
 func (ctrl *OAuthController) tokenError(w http.ResponseWriter, err error) error {
 	data, statusCode, header := ctrl.Service.OauthServer.GetErrorData(err)
 	logrus.Errorf("%s: %s", data["error_description"], data["error"])
@@ -107,11 +177,43 @@ func (ctrl *OAuthController) HandleTokenRequest(w http.ResponseWriter, r *http.R
 }
 
 func (ctrl *OAuthController) TokenHandler(w http.ResponseWriter, r *http.Request) {
+	if !ctrl.checkClientNetwork(w, r) {
+		return
+	}
 	err := ctrl.HandleTokenRequest(w, r)
 	if err != nil {
 		sentry.CaptureException(err)
 	}
 }
+
+// checkClientNetwork writes an access_denied error and returns false
+// if the client can't request tokens from the network of the request.
+func (ctrl *OAuthController) checkClientNetwork(w http.ResponseWriter, r *http.Request) bool {
+	clientId, _, err := service.CombinedClientInfoHandler(r)
+	if err != nil {
+		//the token request itself will fail
+		return true
+	}
+	reason, err := ctrl.Service.CheckClientNetwork(r.Context(), r, clientId)
+	if err != nil {
+		logrus.Errorf("Error checking network restrictions of client %s: %s", clientId, err.Error())
+		sentry.CaptureException(err)
+		err = ctrl.tokenError(w, errors.ErrServerError)
+	} else if reason == "" {
+		return true
+	} else {
+		logrus.Infof("Token request of client %s denied: %s", clientId, reason)
+		err = ctrl.token(w, map[string]interface{}{
+			"error":             errors.ErrAccessDenied.Error(),
+			"error_description": reason,
+		}, nil, http.StatusForbidden)
+	}
+	if err != nil {
+		logrus.Error(err)
+	}
+	return false
+}
+
 func (ctrl *OAuthController) InternalErrorHandler(err error) (re *errors.Response) {
 	//workaround to not show "sql: no rows in result set" to user
 	sentry.CaptureException(err)
@@ -161,17 +263,20 @@ func (ctrl *OAuthController) ListAllClientsHandler(w http.ResponseWriter, r *htt
 	result := []models.ClientMetaData{}
 	err := ctrl.Service.DB.Find(&result, &models.ClientMetaData{}).Error
 	if err != nil {
-		sentry.CaptureException(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		problem.Write(w, r, err)
 		return
 	}
 	response := []models.ListClientsResponse{}
 	for _, md := range result {
 		response = append(response, models.ListClientsResponse{
-			ID:       md.ClientID,
-			Name:     md.Name,
-			ImageURL: md.ImageUrl,
-			URL:      md.URL,
+			ID:                  md.ClientID,
+			Name:                md.Name,
+			ImageURL:            md.ImageUrl,
+			URL:                 md.URL,
+			DailyQuota:          md.DailyQuota,
+			MonthlyQuota:        md.MonthlyQuota,
+			Trusted:             md.Trusted,
+			ClientNetworkPolicy: md.ClientNetworkPolicy,
 		})
 	}
 	w.Header().Add("Content-type", "application/json")
@@ -185,21 +290,52 @@ func (ctrl *OAuthController) FetchClientHandler(w http.ResponseWriter, r *http.R
 	id := mux.Vars(r)["clientId"]
 	result := models.ClientMetaData{}
 	err := ctrl.Service.DB.First(&result, &models.ClientMetaData{ClientID: id}).Error
+	if err == gorm.ErrRecordNotFound {
+		problem.Write(w, r, errClientNotFound)
+		return
+	}
 	if err != nil {
-		sentry.CaptureException(err)
-		status := http.StatusInternalServerError
-		if err == gorm.ErrRecordNotFound {
-			status = http.StatusNotFound
-		}
-		http.Error(w, err.Error(), status)
+		problem.Write(w, r, err)
 		return
 	}
 	w.Header().Add("Content-type", "application/json")
 	err = json.NewEncoder(w).Encode(&models.ListClientsResponse{
-		ID:       result.ClientID,
-		Name:     result.Name,
-		ImageURL: result.ImageUrl,
-		URL:      result.URL,
+		ID:                  result.ClientID,
+		Name:                result.Name,
+		ImageURL:            result.ImageUrl,
+		URL:                 result.URL,
+		DailyQuota:          result.DailyQuota,
+		MonthlyQuota:        result.MonthlyQuota,
+		Trusted:             result.Trusted,
+		ClientNetworkPolicy: result.ClientNetworkPolicy,
+	})
+	if err != nil {
+		logrus.Error(err)
+	}
+}
+
+func (ctrl *OAuthController) FetchClientUsageHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["clientId"]
+	md := models.ClientMetaData{}
+	err := ctrl.Service.DB.First(&md, &models.ClientMetaData{ClientID: id}).Error
+	if err == gorm.ErrRecordNotFound {
+		problem.Write(w, r, errClientNotFound)
+		return
+	}
+	if err != nil {
+		problem.Write(w, r, err)
+		return
+	}
+	daily, monthly, err := ctrl.Service.ClientUsage(r.Context(), &md)
+	if err != nil {
+		problem.Write(w, r, err)
+		return
+	}
+	w.Header().Add("Content-type", "application/json")
+	err = json.NewEncoder(w).Encode(map[string]interface{}{
+		"clientId": id,
+		"daily":    daily,
+		"monthly":  monthly,
 	})
 	if err != nil {
 		logrus.Error(err)
@@ -213,8 +349,7 @@ func (ctrl *OAuthController) ListClientHandler(w http.ResponseWriter, r *http.Re
 		UserID: userId.(string),
 	}).Error
 	if err != nil {
-		sentry.CaptureException(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		problem.Write(w, r, err)
 		return
 	}
 	response := []models.ListClientsResponse{}
@@ -224,15 +359,11 @@ func (ctrl *OAuthController) ListClientHandler(w http.ResponseWriter, r *http.Re
 		clientMetadata := &models.ClientMetaData{}
 		err = ctrl.Service.DB.First(&clientMetadata, &models.ClientMetaData{ClientID: ti.ClientID}).Error
 		if err != nil {
-			sentry.CaptureException(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			problem.Write(w, r, err)
 			return
 		}
 		parsed, _ := url.Parse(ti.RedirectURI)
-		scopes := map[string]string{}
-		for _, sc := range strings.Split(ti.Scope, " ") {
-			scopes[sc] = ctrl.Service.Scopes[sc]
-		}
+		scopes := ctrl.Service.ExpandScopes(ti.Scope)
 		response = append(response, models.ListClientsResponse{
 			Domain:   parsed.Host,
 			ID:       ti.ClientID,
@@ -249,6 +380,44 @@ func (ctrl *OAuthController) ListClientHandler(w http.ResponseWriter, r *http.Re
 	}
 }
 
+func (ctrl *OAuthController) ReloadGatewaysHandler(w http.ResponseWriter, r *http.Request) {
+	endpoints, err := ctrl.Service.ReloadGateways()
+	if err != nil {
+		//the error points to the mistake in the target file, which is what the admin needs to see
+		problem.Write(w, r, problem.New(http.StatusBadRequest, problem.CodeInvalidTargetFile, err.Error()))
+		return
+	}
+	w.Header().Add("Content-type", "application/json")
+	err = json.NewEncoder(w).Encode(map[string]interface{}{
+		"endpoints": len(endpoints),
+		"scopes":    ctrl.Service.Scopes(),
+	})
+	if err != nil {
+		logrus.Error(err)
+	}
+}
+
+func (ctrl *OAuthController) HealthHandler(w http.ResponseWriter, r *http.Request) {
+	status := "ok"
+	upstreams := ctrl.Service.UpstreamHealth()
+	for _, health := range upstreams {
+		if health.CircuitBreaker != "closed" && health.CircuitBreaker != "disabled" {
+			status = "degraded"
+		}
+		if health.HealthCheck == "unhealthy" {
+			status = "degraded"
+		}
+	}
+	w.Header().Add("Content-type", "application/json")
+	err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":    status,
+		"upstreams": upstreams,
+	})
+	if err != nil {
+		logrus.Error(err)
+	}
+}
+
 // should be used for budgets later
 func (ctrl *OAuthController) UpdateClientHandler(w http.ResponseWriter, r *http.Request) {
 }
@@ -258,23 +427,18 @@ func (ctrl *OAuthController) UpdateClientMetadataHandler(w http.ResponseWriter,
 	req := &models.CreateClientRequest{}
 	err := json.NewDecoder(r.Body).Decode(req)
 	if err != nil {
-		logrus.Errorf("Error decoding client info request %s", err.Error())
-		w.WriteHeader(http.StatusBadRequest)
-		_, err = w.Write([]byte("Could not parse create client request"))
-		if err != nil {
-			logrus.Error(err)
-		}
+		problem.Write(w, r, errInvalidClientRequest.WithCause(err))
+		return
+	}
+	err = problem.Validate(&req.ClientNetworkPolicy)
+	if err != nil {
+		problem.Write(w, r, err)
 		return
 	}
 	found := &models.ClientMetaData{}
 	err = ctrl.Service.DB.FirstOrCreate(found, &models.ClientMetaData{ClientID: id}).Error
 	if err != nil {
-		logrus.Errorf("Error storing client info %s", err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
-		_, err = w.Write([]byte("Something went wrong while storing client info"))
-		if err != nil {
-			logrus.Error(err)
-		}
+		problem.Write(w, r, fmt.Errorf("error storing client info: %w", err))
 		return
 	}
 	if req.Name != "" {
@@ -286,22 +450,40 @@ func (ctrl *OAuthController) UpdateClientMetadataHandler(w http.ResponseWriter,
 	if req.URL != "" {
 		found.URL = req.URL
 	}
+	if req.DailyQuota != nil {
+		found.DailyQuota = *req.DailyQuota
+	}
+	if req.MonthlyQuota != nil {
+		found.MonthlyQuota = *req.MonthlyQuota
+	}
+	if req.Trusted != nil {
+		found.Trusted = *req.Trusted
+	}
+	if req.AllowedIPs != nil {
+		found.AllowedIPs = req.AllowedIPs
+	}
+	if req.AllowedCountries != nil {
+		found.AllowedCountries = req.AllowedCountries
+	}
+	if req.BlockedCountries != nil {
+		found.BlockedCountries = req.BlockedCountries
+	}
 	err = ctrl.Service.DB.Save(found).Error
 	if err != nil {
-		logrus.Errorf("Error storing client info %s", err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
-		_, err = w.Write([]byte("Something went wrong while storing client info"))
-		if err != nil {
-			logrus.Error(err)
-		}
+		problem.Write(w, r, fmt.Errorf("error storing client info: %w", err))
 		return
 	}
+	ctrl.Service.InvalidateClientMetaData(id)
 	w.Header().Add("Content-type", "application/json")
 	err = json.NewEncoder(w).Encode(&models.CreateClientResponse{
-		ClientId: id,
-		Name:     req.Name,
-		ImageUrl: req.ImageUrl,
-		Url:      req.URL,
+		ClientId:            id,
+		Name:                req.Name,
+		ImageUrl:            req.ImageUrl,
+		Url:                 req.URL,
+		DailyQuota:          found.DailyQuota,
+		MonthlyQuota:        found.MonthlyQuota,
+		Trusted:             found.Trusted,
+		ClientNetworkPolicy: found.ClientNetworkPolicy,
 	})
 	if err != nil {
 		logrus.Error(err)
@@ -313,19 +495,27 @@ func (ctrl *OAuthController) DeleteClientHandler(w http.ResponseWriter, r *http.
 	clientId := mux.Vars(r)["clientId"]
 	err := ctrl.Service.DB.Table(constants.TokenTableName).Delete(&oauth2gorm.TokenStoreItem{}, &oauth2gorm.TokenStoreItem{ClientID: clientId}).Error
 	if err != nil {
-		sentry.CaptureException(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		problem.Write(w, r, err)
 		return
 	}
+	ctrl.Service.InvalidateClientTokens(r.Context(), clientId)
+	userId, _ := r.Context().Value(CONTEXT_ID_KEY).(string)
+	data, _ := json.Marshal(map[string]string{"clientId": clientId})
+	err = ctrl.Service.EmitEvent(r.Context(), clientId, &models.WebhookEvent{
+		Type:   service.EventGrantRevoked,
+		UserID: userId,
+		Data:   data,
+	})
+	if err != nil {
+		logrus.Errorf("Error sending %s event to client %s: %s", service.EventGrantRevoked, clientId, err.Error())
+	}
 }
 
 func (ctrl *OAuthController) UserAuthorizeMiddleware(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		id, err := ctrl.UserAuthorizeHandler(w, r)
 		if err != nil {
-			logrus.Errorf("Error authenticating user %s", err.Error())
-			sentry.CaptureException(err)
-			http.Error(w, err.Error(), http.StatusUnauthorized)
+			problem.Write(w, r, errUserUnauthorized.WithCause(err))
 			return
 		}
 		r = r.WithContext(context.WithValue(r.Context(), CONTEXT_ID_KEY, id))
@@ -376,21 +566,12 @@ func (ctrl *OAuthController) CreateClientHandler(w http.ResponseWriter, r *http.
 	req := &models.CreateClientRequest{}
 	err := json.NewDecoder(r.Body).Decode(req)
 	if err != nil {
-		logrus.Errorf("Error decoding client info request %s", err.Error())
-		w.WriteHeader(http.StatusBadRequest)
-		_, err = w.Write([]byte("Could not parse create client request"))
-		if err != nil {
-			logrus.Error(err)
-		}
+		problem.Write(w, r, errInvalidClientRequest.WithCause(err))
 		return
 	}
-	err = validator.New().Struct(req)
+	err = problem.Validate(req)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		_, err = w.Write([]byte(err.Error()))
-		if err != nil {
-			logrus.Error(err)
-		}
+		problem.Write(w, r, err)
 		return
 	}
 	id := random.New().String(constants.ClientIdLength)
@@ -405,35 +586,41 @@ func (ctrl *OAuthController) CreateClientHandler(w http.ResponseWriter, r *http.
 		Domain: req.Domain,
 	})
 	if err != nil {
-		logrus.Errorf("Error storing client info %s", err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
-		_, err = w.Write([]byte("Something went wrong while storing client info"))
-		if err != nil {
-			logrus.Error(err)
-		}
+		problem.Write(w, r, fmt.Errorf("error storing client info: %w", err))
 		return
 	}
-	err = ctrl.Service.DB.Create(&models.ClientMetaData{
-		ClientID: id,
-		Name:     req.Name,
-		ImageUrl: req.ImageUrl,
-		URL:      req.URL,
-	}).Error
+	md := &models.ClientMetaData{
+		ClientID:            id,
+		Name:                req.Name,
+		ImageUrl:            req.ImageUrl,
+		URL:                 req.URL,
+		ClientNetworkPolicy: req.ClientNetworkPolicy,
+	}
+	if req.DailyQuota != nil {
+		md.DailyQuota = *req.DailyQuota
+	}
+	if req.MonthlyQuota != nil {
+		md.MonthlyQuota = *req.MonthlyQuota
+	}
+	if req.Trusted != nil {
+		md.Trusted = *req.Trusted
+	}
+	err = ctrl.Service.DB.Create(md).Error
 	if err != nil {
-		logrus.Errorf("Error storing client info %s", err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
-		_, err = w.Write([]byte("Something went wrong while storing client info"))
-		if err != nil {
-			logrus.Error(err)
-		}
+		problem.Write(w, r, fmt.Errorf("error storing client info: %w", err))
 		return
 	}
+	ctrl.Service.InvalidateClientOrigins()
 	w.Header().Add("Content-type", "application/json")
 	err = json.NewEncoder(w).Encode(&models.CreateClientResponse{
-		Name:         req.Name,
-		ImageUrl:     req.ImageUrl,
-		ClientId:     id,
-		ClientSecret: secret,
+		Name:                req.Name,
+		ImageUrl:            req.ImageUrl,
+		ClientId:            id,
+		ClientSecret:        secret,
+		DailyQuota:          md.DailyQuota,
+		MonthlyQuota:        md.MonthlyQuota,
+		Trusted:             md.Trusted,
+		ClientNetworkPolicy: md.ClientNetworkPolicy,
 	})
 	if err != nil {
 		logrus.Error(err)
@@ -448,15 +635,11 @@ func (ctrl *OAuthController) PreRedirectErrorHandler(w http.ResponseWriter, r *s
 
 func (ctrl *OAuthController) AuthorizeScopeHandler(w http.ResponseWriter, r *http.Request) (scope string, err error) {
 	requestedScope := r.FormValue("scope")
-	if requestedScope == "" {
-		return "", fmt.Errorf("Empty scope is not allowed")
-	}
-	for _, scope := range strings.Split(requestedScope, " ") {
-		if _, found := ctrl.Service.Scopes[scope]; !found {
-			err = fmt.Errorf("Scope not allowed: %s", scope)
-			sentry.CaptureException(err)
-			return "", err
-		}
+	//the requested scope is stored as is, it is expanded when the token is used
+	err = ctrl.Service.ValidateRequestedScope(r.Context(), r.FormValue("client_id"), requestedScope)
+	if err != nil {
+		sentry.CaptureException(err)
+		return "", err
 	}
 	return requestedScope, nil
 }
@@ -464,3 +647,27 @@ func (ctrl *OAuthController) AuthorizeScopeHandler(w http.ResponseWriter, r *htt
 type TokenResponse struct {
 	AccessToken string `json:"access_token"`
 }
+
+// StreamTicketHandler exchanges an access token for a ticket that can be passed as query parameter
+// when opening a websocket or event stream, because browsers can't set the Authorization header on those.
+func (ctrl *OAuthController) StreamTicketHandler(w http.ResponseWriter, r *http.Request) {
+	tokenInfo, err := ctrl.Service.OauthServer.ValidationBearerToken(r)
+	if err != nil {
+		problem.Write(w, r, problem.New(http.StatusUnauthorized, problem.CodeInvalidToken, err.Error()))
+		return
+	}
+	ticket, err := ctrl.Service.CreateStreamTicket(r.Context(), tokenInfo)
+	if err != nil {
+		problem.Write(w, r, err)
+		return
+	}
+	w.Header().Add("Content-type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	err = json.NewEncoder(w).Encode(map[string]interface{}{
+		"ticket":     ticket,
+		"expires_in": constants.StreamTicketSeconds,
+	})
+	if err != nil {
+		logrus.Error(err)
+	}
+}
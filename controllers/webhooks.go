@@ -0,0 +1,178 @@
+package controllers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"oauth2server/models"
+	"oauth2server/problem"
+	"oauth2server/service"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+const webhookDeliveriesLimit = 100
+
+var (
+	errInvalidClient   = problem.New(http.StatusUnauthorized, problem.CodeInvalidClient, "Invalid client credentials.")
+	errWebhookNotFound = problem.New(http.StatusNotFound, problem.CodeWebhookNotFound, "Webhook not found.")
+)
+
+// authenticateClient checks the client credentials of a request, from basic auth or the form.
+// Public clients have no secret, so they can't be authenticated.
+func (ctrl *OAuthController) authenticateClient(r *http.Request) (clientId string, err error) {
+	clientId, secret, err := service.CombinedClientInfoHandler(r)
+	if err != nil {
+		return "", err
+	}
+	cli, err := ctrl.Service.ClientStore.GetByID(r.Context(), clientId)
+	if err != nil {
+		return "", fmt.Errorf("invalid client")
+	}
+	if cli.GetSecret() == "" || subtle.ConstantTimeCompare([]byte(cli.GetSecret()), []byte(secret)) != 1 {
+		return "", fmt.Errorf("invalid client")
+	}
+	return clientId, nil
+}
+
+func (ctrl *OAuthController) ListWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	clientId, err := ctrl.authenticateClient(r)
+	if err != nil {
+		problem.Write(w, r, errInvalidClient.WithCause(err))
+		return
+	}
+	endpoints, err := ctrl.Service.WebhookEndpoints(r.Context(), clientId)
+	if err != nil {
+		problem.Write(w, r, err)
+		return
+	}
+	w.Header().Add("Content-type", "application/json")
+	err = json.NewEncoder(w).Encode(endpoints)
+	if err != nil {
+		logrus.Error(err)
+	}
+}
+
+func (ctrl *OAuthController) CreateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	clientId, err := ctrl.authenticateClient(r)
+	if err != nil {
+		problem.Write(w, r, errInvalidClient.WithCause(err))
+		return
+	}
+	req := &models.CreateWebhookRequest{}
+	err = json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		problem.Write(w, r, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Could not parse create webhook request.").WithCause(err))
+		return
+	}
+	err = problem.Validate(req)
+	if err != nil {
+		problem.Write(w, r, err)
+		return
+	}
+	//invalid urls and event types are returned as problem
+	endpoint, err := ctrl.Service.CreateWebhookEndpoint(r.Context(), clientId, req)
+	if err != nil {
+		problem.Write(w, r, err)
+		return
+	}
+	w.Header().Add("Content-type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	err = json.NewEncoder(w).Encode(endpoint)
+	if err != nil {
+		logrus.Error(err)
+	}
+}
+
+func (ctrl *OAuthController) DeleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	clientId, err := ctrl.authenticateClient(r)
+	if err != nil {
+		problem.Write(w, r, errInvalidClient.WithCause(err))
+		return
+	}
+	id, err := strconv.ParseUint(mux.Vars(r)["webhookId"], 10, 64)
+	if err != nil {
+		problem.Write(w, r, errWebhookNotFound)
+		return
+	}
+	found, err := ctrl.Service.DeleteWebhookEndpoint(r.Context(), clientId, uint(id))
+	if err != nil {
+		problem.Write(w, r, err)
+		return
+	}
+	if !found {
+		problem.Write(w, r, errWebhookNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (ctrl *OAuthController) ListWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	clientId, err := ctrl.authenticateClient(r)
+	if err != nil {
+		problem.Write(w, r, errInvalidClient.WithCause(err))
+		return
+	}
+	id, err := strconv.ParseUint(mux.Vars(r)["webhookId"], 10, 64)
+	if err != nil {
+		problem.Write(w, r, errWebhookNotFound)
+		return
+	}
+	deliveries, found, err := ctrl.Service.WebhookDeliveries(r.Context(), clientId, uint(id), webhookDeliveriesLimit)
+	if err != nil {
+		problem.Write(w, r, err)
+		return
+	}
+	if !found {
+		problem.Write(w, r, errWebhookNotFound)
+		return
+	}
+	w.Header().Add("Content-type", "application/json")
+	err = json.NewEncoder(w).Encode(deliveries)
+	if err != nil {
+		logrus.Error(err)
+	}
+}
+
+// IngestEventHandler receives events from the backend, it is protected by WEBHOOK_INGEST_SECRET.
+func (ctrl *OAuthController) IngestEventHandler(w http.ResponseWriter, r *http.Request) {
+	secret := ctrl.Service.Config.WebhookIngestSecret
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if secret == "" || subtle.ConstantTimeCompare([]byte(secret), []byte(token)) != 1 {
+		problem.Write(w, r, problem.New(http.StatusUnauthorized, problem.CodeUnauthorized, "Invalid ingest secret."))
+		return
+	}
+	event := &models.WebhookEvent{}
+	err := json.NewDecoder(r.Body).Decode(event)
+	if err != nil {
+		problem.Write(w, r, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Could not parse event.").WithCause(err))
+		return
+	}
+	err = problem.Validate(event)
+	if err != nil {
+		problem.Write(w, r, err)
+		return
+	}
+	if _, found := ctrl.Service.WebhookEvents()[event.Type]; !found || event.Type == service.EventGrantRevoked {
+		problem.Write(w, r, problem.New(http.StatusBadRequest, problem.CodeUnknownEventType, fmt.Sprintf("Unknown event type %s.", event.Type)))
+		return
+	}
+	deliveries, err := ctrl.Service.IngestEvent(r.Context(), event)
+	if err != nil {
+		problem.Write(w, r, fmt.Errorf("error ingesting event %s: %w", event.Type, err))
+		return
+	}
+	w.Header().Add("Content-type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	err = json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":         event.ID,
+		"deliveries": deliveries,
+	})
+	if err != nil {
+		logrus.Error(err)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"oauth2server/constants"
 	"oauth2server/controllers"
 	"oauth2server/models"
+	"oauth2server/problem"
 	"oauth2server/service"
 	"testing"
 
@@ -45,17 +46,42 @@ func TestCreateClient(t *testing.T) {
 	reqBody.Domain = "invalid"
 	_, err = createClient(controller, &reqBody)
 	assert.Error(t, err)
+	//the error is a problem that points to the field
+	var buf bytes.Buffer
+	err = json.NewEncoder(&buf).Encode(reqBody)
+	assert.NoError(t, err)
+	req, err := http.NewRequest(http.MethodPost, "/admin/clients", &buf)
+	assert.NoError(t, err)
+	rec := httptest.NewRecorder()
+	http.HandlerFunc(controller.CreateClientHandler).ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, problem.ContentType, rec.Header().Get("Content-Type"))
+	p := &problem.Problem{}
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(p))
+	assert.Equal(t, problem.CodeValidationFailed, p.Code)
+	assert.Equal(t, "/admin/clients", p.Instance)
+	assert.Equal(t, []problem.FieldError{{Field: "domain", Error: "failed the uri validation"}}, p.Errors)
+	//unknown clients are not found
+	req, err = http.NewRequest(http.MethodGet, "/admin/clients/{clientId}", nil)
+	assert.NoError(t, err)
+	req = mux.SetURLVars(req, map[string]string{"clientId": "unknown"})
+	rec = httptest.NewRecorder()
+	http.HandlerFunc(controller.FetchClientHandler).ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	p = &problem.Problem{}
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(p))
+	assert.Equal(t, problem.CodeClientNotFound, p.Code)
 	//update the client
 	reqBody.Name = "new name"
-	var buf bytes.Buffer
+	buf.Reset()
 	err = json.NewEncoder(&buf).Encode(reqBody)
 	assert.NoError(t, err)
-	req, err := http.NewRequest(http.MethodPut, "/admin/clients/{clientId}", &buf)
+	req, err = http.NewRequest(http.MethodPut, "/admin/clients/{clientId}", &buf)
 	req = mux.SetURLVars(req, map[string]string{
 		"clientId": resp.ClientId,
 	})
 	assert.NoError(t, err)
-	rec := httptest.NewRecorder()
+	rec = httptest.NewRecorder()
 	http.HandlerFunc(controller.UpdateClientMetadataHandler).ServeHTTP(rec, req)
 	assert.Equal(t, rec.Result().StatusCode, http.StatusOK)
 	found := &models.ClientMetaData{}
@@ -3,6 +3,7 @@ package integrationtests
 import (
 	"context"
 	"encoding/json"
+	"expvar"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -145,3 +146,49 @@ func TestListDeleteTokensForClient(t *testing.T) {
 	err = dropTables(svc.DB, constants.ClientTableName, constants.ClientMetadataTableName, constants.TokenTableName)
 	assert.NoError(t, err)
 }
+
+func TestTokenCache(t *testing.T) {
+	conf := *testConfig
+	conf.TokenCacheSize = 100
+	conf.TokenCacheSeconds = 60
+	svc, err := service.InitService(&conf)
+	assert.NoError(t, err)
+	controller := &controllers.OAuthController{Service: svc}
+	cli, err := createClient(controller, &testClient)
+	assert.NoError(t, err)
+	token1, err := createToken(svc, cli, "1", "balance:read")
+	assert.NoError(t, err)
+	token2, err := createToken(svc, cli, "2", "balance:read")
+	assert.NoError(t, err)
+
+	hits := expvar.Get("token_cache_hits").(*expvar.Int)
+	misses := expvar.Get("token_cache_misses").(*expvar.Int)
+	hitsBefore, missesBefore := hits.Value(), misses.Value()
+	for i := 0; i < 3; i++ {
+		_, err = svc.OauthServer.Manager.LoadAccessToken(context.Background(), token1.GetAccess())
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, hitsBefore+2, hits.Value())
+	assert.Equal(t, missesBefore+1, misses.Value())
+
+	//a revoked token is not served from the cache
+	err = svc.OauthServer.Manager.RemoveAccessToken(context.Background(), token1.GetAccess())
+	assert.NoError(t, err)
+	_, err = svc.OauthServer.Manager.LoadAccessToken(context.Background(), token1.GetAccess())
+	assert.Error(t, err)
+
+	//neither are the tokens of a deleted client
+	_, err = svc.OauthServer.Manager.LoadAccessToken(context.Background(), token2.GetAccess())
+	assert.NoError(t, err)
+	req, err := http.NewRequest(http.MethodDelete, "/clients/"+cli.ClientId, nil)
+	assert.NoError(t, err)
+	req = mux.SetURLVars(req, map[string]string{"clientId": cli.ClientId})
+	rec := httptest.NewRecorder()
+	http.HandlerFunc(controller.DeleteClientHandler).ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	_, err = svc.OauthServer.Manager.LoadAccessToken(context.Background(), token2.GetAccess())
+	assert.Error(t, err)
+
+	err = dropTables(svc.DB, constants.ClientTableName, constants.ClientMetadataTableName, constants.TokenTableName)
+	assert.NoError(t, err)
+}
@@ -2,12 +2,16 @@ package integrationtests
 
 import (
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"oauth2server/constants"
 	"oauth2server/middleware"
+	"oauth2server/service"
+	"path/filepath"
 	"strings"
 	"testing"
 
@@ -81,8 +85,312 @@ func TestGateway(t *testing.T) {
 	//wrap gateway with mw
 	gw2 := middleware.RegisterMiddleware(gateways[1], svc.Config)
 	gw2.ServeHTTP(rec, req)
-	assert.Equal(t, http.StatusUnauthorized, rec.Result().StatusCode)
+	assert.Equal(t, http.StatusForbidden, rec.Result().StatusCode)
+	assert.Equal(t, `Bearer error="insufficient_scope", error_description="Token does not have the right scope for operation: token scope balance:read, endpoint scope invoices:read", scope="invoices:read"`, rec.Header().Get("WWW-Authenticate"))
 
 	err = dropTables(svc.DB, constants.ClientTableName, constants.ClientMetadataTableName, constants.TokenTableName)
 	assert.NoError(t, err)
 }
+
+func TestPathPrefix(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer ts.Close()
+	svc, _, _, token := initGatewayTest(t, fmt.Sprintf(`[
+		{"matchRoute": "/balance", "origin": "%[1]s", "description": "Read your balance.", "scope": "balance:read"},
+		{"matchRoute": "/v2/", "pathPrefix": true, "rewrite": "/api/", "origin": "%[1]s", "description": "Read your balance.", "scope": "balance:read"}
+	]`, ts.URL), "balance:read")
+
+	//exact routes are not rewritten
+	rec := gatewayRequest(t, svc, token.GetAccess(), http.MethodGet, "/balance", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "/balance", rec.Body.String())
+	//the prefix is replaced by the rewrite
+	rec = gatewayRequest(t, svc, token.GetAccess(), http.MethodGet, "/v2/invoices/incoming", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "/api/invoices/incoming", rec.Body.String())
+
+	dropGatewayTables(t, svc)
+}
+
+func TestReloadGateways(t *testing.T) {
+	targetFile := filepath.Join(t.TempDir(), "targets.json")
+	err := ioutil.WriteFile(targetFile, []byte(`[{"matchRoute": "/balance", "origin": "http://localhost:8082", "description": "Read your balance.", "scope": "balance:read"}]`), 0644)
+	assert.NoError(t, err)
+	svc := &service.Service{
+		Config: &service.Config{TargetFile: targetFile},
+	}
+	_, err = svc.InitGateways()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"balance:read": "Read your balance."}, svc.Scopes())
+
+	//an invalid config should be rejected and the old one kept
+	err = ioutil.WriteFile(targetFile, []byte(`[{"matchRoute": "/balance", "origin": "not a url", "scope": "balance:read"}]`), 0644)
+	assert.NoError(t, err)
+	_, err = svc.ReloadGateways()
+	assert.Error(t, err)
+	assert.Equal(t, 1, len(svc.Endpoints()))
+	assert.Equal(t, "http://localhost:8082", svc.Endpoints()[0].Origin)
+
+	//a valid config should replace the routes and the scopes
+	err = ioutil.WriteFile(targetFile, []byte(`[{"matchRoute": "/invoices/incoming", "origin": "http://localhost:8082", "description": "Read your invoice history.", "scope": "invoices:read"}]`), 0644)
+	assert.NoError(t, err)
+	endpoints, err := svc.ReloadGateways()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(endpoints))
+	assert.Equal(t, map[string]string{"invoices:read": "Read your invoice history."}, svc.Scopes())
+	rec := gatewayRequest(t, svc, "", http.MethodGet, "/balance", "")
+	assert.Equal(t, http.StatusNotFound, rec.Result().StatusCode)
+}
+
+func TestHostRouting(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "api")
+	}))
+	defer ts.Close()
+	partner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "partner")
+	}))
+	defer partner.Close()
+	svc, controller, _, token := initGatewayTest(t, fmt.Sprintf(`[
+		{"matchRoute": "/balance", "origin": "%[1]s", "description": "Read your balance.", "scope": "balance:read"},
+		{"matchRoute": "/invoices", "origin": "%[1]s", "description": "Read your invoices.", "scope": "invoices:read"},
+		{"matchRoute": "/balance", "host": "partner.example.com", "origin": "%[2]s", "description": "Read your partner balance.", "scope": "partner:read"}
+	]`, ts.URL, partner.URL), "balance:read partner:read")
+	svc.Config.PublicURL = "https://api.example.com"
+
+	doRequest := func(host string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(http.MethodGet, "/balance", nil)
+		assert.NoError(t, err)
+		req.Host = host
+		return serveGateway(svc, token.GetAccess(), req)
+	}
+	//the route of the host takes precedence, the port does not matter
+	assert.Equal(t, "partner", doRequest("partner.example.com:8080").Body.String())
+	assert.Equal(t, "api", doRequest("api.example.com").Body.String())
+
+	getJSON := func(handler http.HandlerFunc, path, host string, result interface{}) {
+		req, err := http.NewRequest(http.MethodGet, path, nil)
+		assert.NoError(t, err)
+		req.Host = host
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.NoError(t, json.NewDecoder(rec.Body).Decode(result))
+	}
+	//hosts with targets of their own have their own scopes, other hosts get all scopes
+	scopes := map[string]string{}
+	getJSON(controller.ScopeHandler, "/oauth/scopes", "partner.example.com", &scopes)
+	assert.Equal(t, map[string]string{"partner:read": "Read your partner balance.", "balance:read": "Read your balance.", "invoices:read": "Read your invoices."}, scopes)
+	scopes = map[string]string{}
+	getJSON(controller.ScopeHandler, "/oauth/scopes", "api.example.com", &scopes)
+	assert.Equal(t, 3, len(scopes))
+
+	metadata := struct {
+		Issuer                string   `json:"issuer"`
+		AuthorizationEndpoint string   `json:"authorization_endpoint"`
+		TokenEndpoint         string   `json:"token_endpoint"`
+		ScopesSupported       []string `json:"scopes_supported"`
+	}{}
+	getJSON(controller.DiscoveryHandler, "/.well-known/oauth-authorization-server", "partner.example.com", &metadata)
+	assert.Equal(t, "https://partner.example.com", metadata.Issuer)
+	assert.Equal(t, "https://partner.example.com/oauth/token", metadata.TokenEndpoint)
+	assert.Equal(t, []string{"balance:read", "invoices:read", "partner:read"}, metadata.ScopesSupported)
+	getJSON(controller.DiscoveryHandler, "/.well-known/oauth-authorization-server", "oauth.example.com", &metadata)
+	assert.Equal(t, "https://api.example.com", metadata.Issuer)
+	assert.Equal(t, "https://api.example.com/oauth/authorize", metadata.AuthorizationEndpoint)
+
+	//without PUBLIC_URL, the Host and X-Forwarded-Proto headers of a client are not used for the urls
+	svc.Config.PublicURL = ""
+	getJSON(controller.DiscoveryHandler, "/.well-known/oauth-authorization-server", "evil.example.com", &metadata)
+	assert.Equal(t, fmt.Sprintf("http://localhost:%d", svc.Config.Port), metadata.Issuer)
+	req, err := http.NewRequest(http.MethodGet, "/.well-known/oauth-authorization-server", nil)
+	assert.NoError(t, err)
+	req.Host = "partner.example.com"
+	req.Header.Set("X-Forwarded-Proto", "https")
+	rec := httptest.NewRecorder()
+	controller.DiscoveryHandler(rec, req)
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&metadata))
+	assert.Equal(t, "http://partner.example.com", metadata.Issuer)
+
+	dropGatewayTables(t, svc)
+}
+
+func TestOpenAPI(t *testing.T) {
+	svc, controller := initServiceWithTargets(t, `[
+		{"matchRoute": "/invoices", "origin": "http://localhost:3000", "description": "Create invoices on your behalf.", "scope": "invoices:create", "methods": ["POST"],
+			"requestSchema": {"type": "object", "required": ["amount"], "properties": {"amount": {"type": "integer"}}},
+			"responseSchema": {"type": "object", "properties": {"payment_request": {"type": "string"}}}},
+		{"matchRoute": "/invoices/{payment_hash:[0-9a-f]+}", "origin": "http://localhost:3000", "description": "Read your invoices.", "scope": "invoices:read"}
+	]`)
+	svc.Config.PublicURL = "https://api.example.com/"
+	req, err := http.NewRequest(http.MethodGet, "/oauth/openapi.json", nil)
+	assert.NoError(t, err)
+	rec := httptest.NewRecorder()
+	controller.OpenAPIHandler(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	doc := struct {
+		OpenAPI string `json:"openapi"`
+		Servers []struct {
+			URL string `json:"url"`
+		} `json:"servers"`
+		Paths      map[string]map[string]map[string]interface{} `json:"paths"`
+		Components struct {
+			SecuritySchemes map[string]struct {
+				Flows struct {
+					AuthorizationCode struct {
+						AuthorizationURL string            `json:"authorizationUrl"`
+						TokenURL         string            `json:"tokenUrl"`
+						Scopes           map[string]string `json:"scopes"`
+					} `json:"authorizationCode"`
+				} `json:"flows"`
+			} `json:"securitySchemes"`
+		} `json:"components"`
+	}{}
+	body := rec.Body.String()
+	err = json.Unmarshal([]byte(body), &doc)
+	assert.NoError(t, err)
+	assert.Equal(t, "3.1.0", doc.OpenAPI)
+	assert.Equal(t, "https://api.example.com", doc.Servers[0].URL)
+	flow := doc.Components.SecuritySchemes["oauth2"].Flows.AuthorizationCode
+	assert.Equal(t, "https://api.example.com/oauth/authorize", flow.AuthorizationURL)
+	assert.Equal(t, "https://api.example.com/oauth/token", flow.TokenURL)
+	assert.Equal(t, "Create invoices on your behalf.", flow.Scopes["invoices:create"])
+
+	create := doc.Paths["/invoices"]["post"]
+	assert.NotNil(t, create)
+	assert.Nil(t, doc.Paths["/invoices"]["get"])
+	assert.Equal(t, []interface{}{map[string]interface{}{"oauth2": []interface{}{"invoices:create"}}}, create["security"])
+	assert.NotNil(t, create["requestBody"])
+	//access token errors are RFC 6750 errors with a WWW-Authenticate header
+	unauthorized := create["responses"].(map[string]interface{})["401"].(map[string]interface{})
+	assert.Contains(t, unauthorized["headers"], "WWW-Authenticate")
+	assert.Contains(t, body, `"$ref":"#/components/schemas/BearerError"`)
+	assert.Contains(t, body, `"error_description"`)
+	assert.Contains(t, body, `"payment_request"`)
+
+	read := doc.Paths["/invoices/{payment_hash}"]["get"]
+	assert.NotNil(t, read)
+	assert.Equal(t, []interface{}{map[string]interface{}{
+		"name": "payment_hash", "in": "path", "required": true,
+		"schema": map[string]interface{}{"type": "string", "pattern": "^[0-9a-f]+$"},
+	}}, read["parameters"])
+}
+
+func TestScopeImplications(t *testing.T) {
+	var scopesHeader string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scopesHeader = r.Header.Get("X-OAuth-Scopes")
+	}))
+	defer ts.Close()
+	svc, controller := initServiceWithTargets(t, fmt.Sprintf(`{
+		"targets": [
+			{"matchRoute": "/invoices", "origin": "%[1]s", "description": "Create invoices on your behalf.", "scope": "invoices:create"},
+			{"matchRoute": "/invoices/incoming", "origin": "%[1]s", "description": "Read your invoices.", "scope": "invoices:read"},
+			{"matchRoute": "/balance", "origin": "%[1]s", "description": "Read your balance.", "scope": "balance:read"}
+		],
+		"scopeImplications": {"invoices:create": ["invoices:read"], "invoices:read": ["balance:read"]}
+	}`, ts.URL))
+	cli, err := createClient(controller, &testClient)
+	assert.NoError(t, err)
+	trusted := true
+	trustedClient := testClient
+	trustedClient.Trusted = &trusted
+	trustedCli, err := createClient(controller, &trustedClient)
+	assert.NoError(t, err)
+
+	doRequest := func(scope, path string) int {
+		token, err := createToken(svc, cli, "1", scope)
+		assert.NoError(t, err)
+		return gatewayRequest(t, svc, token.GetAccess(), http.MethodGet, path, "").Code
+	}
+	//implied, also indirectly
+	assert.Equal(t, http.StatusOK, doRequest("invoices:create", "/invoices/incoming"))
+	assert.Equal(t, http.StatusOK, doRequest("invoices:create", "/balance"))
+	assert.Equal(t, "balance:read invoices:create invoices:read", scopesHeader)
+	assert.NotEqual(t, http.StatusOK, doRequest("invoices:read", "/invoices"))
+	//wildcards
+	assert.Equal(t, http.StatusOK, doRequest("invoices:*", "/invoices"))
+	assert.NotEqual(t, http.StatusOK, doRequest("balance:*", "/invoices"))
+
+	//only trusted clients can ask for wildcards
+	authorizeScope := func(clientId, scope string) error {
+		req, err := http.NewRequest(http.MethodPost, "/oauth/authorize", strings.NewReader(url.Values{"client_id": {clientId}, "scope": {scope}}.Encode()))
+		assert.NoError(t, err)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		_, err = controller.AuthorizeScopeHandler(httptest.NewRecorder(), req)
+		return err
+	}
+	assert.NoError(t, authorizeScope(cli.ClientId, "invoices:create balance:read"))
+	assert.Error(t, authorizeScope(cli.ClientId, "invoices:*"))
+	assert.NoError(t, authorizeScope(trustedCli.ClientId, "invoices:*"))
+	assert.Error(t, authorizeScope(trustedCli.ClientId, "payments:*"))
+
+	//the consent screen shows the expanded scopes
+	req, err := http.NewRequest(http.MethodGet, "/oauth/scopes?scope=invoices:read", nil)
+	assert.NoError(t, err)
+	rec := httptest.NewRecorder()
+	controller.ScopeHandler(rec, req)
+	scopes := map[string]string{}
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&scopes))
+	assert.Equal(t, map[string]string{"invoices:read": "Read your invoices.", "balance:read": "Read your balance."}, scopes)
+
+	dropGatewayTables(t, svc)
+}
+
+func TestCORS(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	svc, controller := initServiceWithTargets(t, fmt.Sprintf(`[{"matchRoute": "/balance", "origin": "%s", "description": "Read your balance.", "scope": "balance:read"}]`, ts.URL))
+	publicClient := testClient
+	publicClient.Public = true
+	cli, err := createClient(controller, &publicClient)
+	assert.NoError(t, err)
+	otherClient := testClient
+	otherClient.Domain = "https://other.example.com/callback"
+	_, err = createClient(controller, &otherClient)
+	assert.NoError(t, err)
+	token, err := createToken(svc, cli, "1", "balance:read")
+	assert.NoError(t, err)
+	gateway := middleware.CORSMiddleware(svc, []string{http.MethodGet}, false)(svc.GatewayHandler())
+	tokenEndpoint := middleware.CORSMiddleware(svc, []string{http.MethodPost}, true)(http.HandlerFunc(controller.TokenHandler))
+
+	doRequest := func(handler http.Handler, method, path, origin string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, nil)
+		assert.NoError(t, err)
+		req.Header.Set("Origin", origin)
+		if method == http.MethodOptions {
+			req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+			req.Header.Set("Access-Control-Request-Headers", "authorization")
+		} else {
+			req.Header.Set("Authorization", "Bearer "+token.GetAccess())
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	//preflight
+	rec := doRequest(gateway, http.MethodOptions, "/balance", "http://example.com")
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Equal(t, "http://example.com", rec.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "authorization", rec.Header().Get("Access-Control-Allow-Headers"))
+	assert.Empty(t, rec.Header().Get("Access-Control-Allow-Credentials"))
+	rec = doRequest(gateway, http.MethodOptions, "/balance", "https://evil.example.com")
+	assert.Empty(t, rec.Header().Get("Access-Control-Allow-Origin"))
+	//the token endpoint only allows the origins of public clients
+	rec = doRequest(tokenEndpoint, http.MethodOptions, "/oauth/token", "http://example.com")
+	assert.Equal(t, "http://example.com", rec.Header().Get("Access-Control-Allow-Origin"))
+	rec = doRequest(tokenEndpoint, http.MethodOptions, "/oauth/token", "https://other.example.com")
+	assert.Empty(t, rec.Header().Get("Access-Control-Allow-Origin"))
+
+	rec = doRequest(gateway, http.MethodGet, "/balance", "http://example.com")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "http://example.com", rec.Header().Get("Access-Control-Allow-Origin"))
+	//the origin of another client can't use this token
+	rec = doRequest(gateway, http.MethodGet, "/balance", "https://other.example.com")
+	assert.Empty(t, rec.Header().Get("Access-Control-Allow-Origin"))
+
+	dropGatewayTables(t, svc)
+}
@@ -0,0 +1,190 @@
+package integrationtests
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"oauth2server/models"
+	"oauth2server/service"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	store := service.NewMemoryRateLimitStore()
+	limit := &service.RateLimit{
+		Requests: 1,
+		Period:   service.Duration{Duration: 100 * time.Millisecond},
+		Burst:    2,
+	}
+	//the bucket starts full
+	allowed, remaining, err := store.Take(context.Background(), "user:1", limit)
+	assert.NoError(t, err)
+	assert.True(t, allowed)
+	assert.InDelta(t, 1, remaining, 0.1)
+	allowed, _, err = store.Take(context.Background(), "user:1", limit)
+	assert.NoError(t, err)
+	assert.True(t, allowed)
+	allowed, _, err = store.Take(context.Background(), "user:1", limit)
+	assert.NoError(t, err)
+	assert.False(t, allowed)
+	//other keys have their own bucket
+	allowed, _, err = store.Take(context.Background(), "user:2", limit)
+	assert.NoError(t, err)
+	assert.True(t, allowed)
+	//the bucket is refilled after the period
+	time.Sleep(110 * time.Millisecond)
+	allowed, _, err = store.Take(context.Background(), "user:1", limit)
+	assert.NoError(t, err)
+	assert.True(t, allowed)
+	//a refunded token can be taken again
+	allowed, _, err = store.Take(context.Background(), "user:1", limit)
+	assert.NoError(t, err)
+	assert.False(t, allowed)
+	err = store.Refund(context.Background(), "user:1", limit)
+	assert.NoError(t, err)
+	allowed, _, err = store.Take(context.Background(), "user:1", limit)
+	assert.NoError(t, err)
+	assert.True(t, allowed)
+}
+
+func TestRejectedRequestUsesNoBucket(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer ts.Close()
+	svc, controller := initServiceWithTargets(t, fmt.Sprintf(`{
+		"targets": [
+			{"matchRoute": "/balance", "origin": "%[1]s", "description": "Read your balance.", "scope": "balance:read"},
+			{"matchRoute": "/invoices", "origin": "%[1]s", "description": "Read your invoices.", "scope": "invoices:read"}
+		],
+		"rateLimits": {
+			"user": {"requests": 10, "period": "1m"},
+			"scopes": {"balance:read": {"requests": 1, "period": "1m"}}
+		}
+	}`, ts.URL))
+	cli, err := createClient(controller, &testClient)
+	assert.NoError(t, err)
+	//a user of its own, so the buckets are not shared with other tests
+	token, err := createToken(svc, cli, "ratelimit", "balance:read invoices:read")
+	assert.NoError(t, err)
+
+	doRequest := func(path string) *httptest.ResponseRecorder {
+		return gatewayRequest(t, svc, token.GetAccess(), http.MethodGet, path, "")
+	}
+	assert.Equal(t, http.StatusOK, doRequest("/balance").Code)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusTooManyRequests, doRequest("/balance").Code)
+	}
+	//the requests rejected by the scope bucket did not use the user bucket
+	rec := doRequest("/invoices")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "8", rec.Header().Get("RateLimit-Remaining"))
+
+	dropGatewayTables(t, svc)
+}
+
+func TestClientQuota(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := w.Write([]byte("ok"))
+		assert.NoError(t, err)
+	}))
+	defer ts.Close()
+	svc, controller := initServiceWithTargets(t, fmt.Sprintf(`[{"matchRoute": "/balance", "origin": "%s", "description": "Read your balance.", "scope": "balance:read"}]`, ts.URL))
+	dailyQuota, monthlyQuota := int64(2), int64(10)
+	reqBody := testClient
+	reqBody.DailyQuota = &dailyQuota
+	reqBody.MonthlyQuota = &monthlyQuota
+	cli, err := createClient(controller, &reqBody)
+	assert.NoError(t, err)
+	assert.Equal(t, dailyQuota, cli.DailyQuota)
+	token, err := createToken(svc, cli, "1", "balance:read")
+	assert.NoError(t, err)
+
+	for i := int64(1); i <= dailyQuota+3; i++ {
+		rec := gatewayRequest(t, svc, token.GetAccess(), http.MethodGet, "/balance", "")
+		assert.Equal(t, "2", rec.Header().Get("X-Quota-Daily-Limit"))
+		if i <= dailyQuota {
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, fmt.Sprint(dailyQuota-i), rec.Header().Get("X-Quota-Daily-Remaining"))
+		} else {
+			assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+			assert.Equal(t, "application/problem+json", rec.Header().Get("Content-Type"))
+			assert.Contains(t, rec.Body.String(), `"code":"quota_exceeded"`)
+			assert.NotEmpty(t, rec.Header().Get("Retry-After"))
+			//the monthly quota is not used by requests that are rejected by the daily quota
+			assert.Equal(t, fmt.Sprint(monthlyQuota-dailyQuota), rec.Header().Get("X-Quota-Monthly-Remaining"))
+		}
+	}
+
+	//rejected requests are not counted
+	req, err := http.NewRequest(http.MethodGet, "/admin/clients/{clientId}/usage", nil)
+	assert.NoError(t, err)
+	req = mux.SetURLVars(req, map[string]string{
+		"clientId": cli.ClientId,
+	})
+	rec := httptest.NewRecorder()
+	http.HandlerFunc(controller.FetchClientUsageHandler).ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	usage := map[string]map[string]interface{}{}
+	err = json.NewDecoder(rec.Body).Decode(&usage)
+	assert.NoError(t, err)
+	assert.EqualValues(t, dailyQuota, usage["daily"]["used"])
+	assert.EqualValues(t, dailyQuota, usage["monthly"]["used"])
+
+	dropGatewayTables(t, svc)
+}
+
+func TestClientNetworkPolicy(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	conf := *testConfig
+	//httptest requests come from 192.0.2.1
+	conf.TrustedProxies = "192.0.2.0/24"
+	svc, controller := initServiceWithConfig(t, conf, fmt.Sprintf(`[{"matchRoute": "/balance", "origin": "%s", "description": "Read your balance.", "scope": "balance:read"}]`, ts.URL))
+	restrictedClient := testClient
+	restrictedClient.ClientNetworkPolicy = models.ClientNetworkPolicy{
+		AllowedIPs:       []string{"10.0.0.0/8", "203.0.113.7"},
+		BlockedCountries: []string{"KP"},
+	}
+	cli, err := createClient(controller, &restrictedClient)
+	assert.NoError(t, err)
+	token, err := createToken(svc, cli, "1", "balance:read")
+	assert.NoError(t, err)
+	invalidClient := testClient
+	invalidClient.AllowedIPs = []string{"10.0.0.0/33"}
+	_, err = createClient(controller, &invalidClient)
+	assert.Error(t, err)
+
+	doRequest := func(forwardedFor, country string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/balance", nil)
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		req.Header.Set("CF-IPCountry", country)
+		return serveGateway(svc, token.GetAccess(), req)
+	}
+	assert.Equal(t, http.StatusOK, doRequest("10.1.2.3", "DE").Code)
+	assert.Equal(t, http.StatusOK, doRequest("203.0.113.7", "").Code)
+	assert.Equal(t, http.StatusForbidden, doRequest("198.51.100.1", "DE").Code)
+	//addresses added by the client itself are ignored
+	assert.Equal(t, http.StatusForbidden, doRequest("10.1.2.3, 198.51.100.1", "DE").Code)
+	assert.Equal(t, http.StatusForbidden, doRequest("10.1.2.3", "KP").Code)
+
+	//the token endpoint is restricted as well
+	form := url.Values{"grant_type": {"client_credentials"}, "client_id": {cli.ClientId}, "client_secret": {cli.ClientSecret}}
+	req := httptest.NewRequest(http.MethodPost, "/oauth/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	rec := httptest.NewRecorder()
+	controller.TokenHandler(rec, req)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Contains(t, rec.Body.String(), "access_denied")
+
+	dropGatewayTables(t, svc)
+}
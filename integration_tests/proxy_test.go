@@ -0,0 +1,553 @@
+package integrationtests
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"oauth2server/constants"
+	"oauth2server/service"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-oauth2/oauth2/v4/models"
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeaderPolicy(t *testing.T) {
+	headers := make(chan http.Header, 2)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header
+	}))
+	defer ts.Close()
+	svc, _, cli, token := initGatewayTest(t, fmt.Sprintf(`[
+		{"matchRoute": "/balance", "origin": "%[1]s", "description": "Read your balance.", "scope": "balance:read", "headers": {"allow": ["X-Request-Id"]}},
+		{"matchRoute": "/user/summary", "origin": "%[1]s", "description": "Read your account summary.", "scope": "balance:read", "headers": {"deny": ["Cookie"]}}
+	]`, ts.URL), "balance:read")
+
+	for _, path := range []string{"/balance", "/user/summary"} {
+		req, err := http.NewRequest(http.MethodGet, path, nil)
+		assert.NoError(t, err)
+		req.Header.Set("Cookie", "session=secret")
+		req.Header.Set("X-Request-Id", "abc")
+		req.Header.Set("X-Custom", "value")
+		req.Header.Set("Connection", "X-Hop")
+		req.Header.Set("X-Hop", "value")
+		//context headers can't be spoofed by clients
+		req.Header.Set("X-OAuth-User-Id", "2")
+		req.Header.Set("X-OAuth-Admin", "true")
+		rec := serveGateway(svc, token.GetAccess(), req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		received := <-headers
+		assert.Equal(t, cli.ClientId, received.Get("X-OAuth-Client-Id"))
+		assert.Equal(t, "1", received.Get("X-OAuth-User-Id"))
+		assert.Equal(t, "balance:read", received.Get("X-OAuth-Scopes"))
+		assert.Empty(t, received.Get("X-OAuth-Admin"))
+		assert.Empty(t, received.Get("X-Hop"))
+		assert.Empty(t, received.Get("Cookie"))
+		assert.Equal(t, "abc", received.Get("X-Request-Id"))
+		if path == "/balance" {
+			assert.Empty(t, received.Get("X-Custom"))
+		} else {
+			assert.Equal(t, "value", received.Get("X-Custom"))
+		}
+	}
+
+	dropGatewayTables(t, svc)
+}
+
+func TestCredentialInjectors(t *testing.T) {
+	os.Setenv("TEST_UPSTREAM_SECRET", "upstream secret")
+	defer os.Unsetenv("TEST_UPSTREAM_SECRET")
+	requests := make(chan *http.Request, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r
+	}))
+	defer ts.Close()
+	svc, _, cli, token := initGatewayTest(t, fmt.Sprintf(`[
+		{"matchRoute": "/jwt", "origin": "%[1]s", "description": "JWT.", "scope": "test", "credentials": {"type": "jwt", "issuer": "gateway", "audience": "api", "claims": {"app": "{client_id}"}, "secretEnv": "TEST_UPSTREAM_SECRET"}},
+		{"matchRoute": "/apikey", "origin": "%[1]s", "description": "API key.", "scope": "test", "credentials": {"type": "apiKey", "secretEnv": "TEST_UPSTREAM_SECRET"}},
+		{"matchRoute": "/hmac", "origin": "%[1]s/api", "description": "HMAC.", "scope": "test", "credentials": {"type": "hmac", "secretEnv": "TEST_UPSTREAM_SECRET"}},
+		{"matchRoute": "/none", "origin": "%[1]s", "description": "None.", "scope": "test", "credentials": {"type": "none"}}
+	]`, ts.URL), "test")
+
+	doRequest := func(path, body string) *http.Request {
+		rec := gatewayRequest(t, svc, token.GetAccess(), http.MethodPost, path, body)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		return <-requests
+	}
+	received := doRequest("/jwt", "")
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(strings.TrimPrefix(received.Header.Get("Authorization"), "Bearer "), claims, func(token *jwt.Token) (interface{}, error) {
+		return []byte("upstream secret"), nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "1", claims["sub"])
+	assert.Equal(t, "gateway", claims["iss"])
+	assert.Equal(t, "api", claims["aud"])
+	assert.Equal(t, cli.ClientId, claims["app"])
+
+	received = doRequest("/apikey", "")
+	assert.Equal(t, "upstream secret", received.Header.Get("X-Api-Key"))
+	//the access token of the client is not forwarded
+	assert.Empty(t, received.Header.Get("Authorization"))
+
+	received = doRequest("/hmac?a=b", `{"amount": 1}`)
+	bodyHash := sha256.Sum256([]byte(`{"amount": 1}`))
+	mac := hmac.New(sha256.New, []byte("upstream secret"))
+	mac.Write([]byte(strings.Join([]string{received.Header.Get("X-Signature-Timestamp"), http.MethodPost, "/api/hmac?a=b", hex.EncodeToString(bodyHash[:])}, "\n")))
+	assert.Equal(t, hex.EncodeToString(mac.Sum(nil)), received.Header.Get("X-Signature"))
+
+	received = doRequest("/none", "")
+	assert.Empty(t, received.Header.Get("Authorization"))
+
+	dropGatewayTables(t, svc)
+}
+
+func TestMintedTokenReuse(t *testing.T) {
+	svc := &service.Service{Config: &service.Config{JWTSecret: []byte("secret")}}
+	inject := func(userId string) string {
+		req, err := http.NewRequest(http.MethodGet, "/balance", nil)
+		assert.NoError(t, err)
+		err = svc.InjectJWTAccessToken(&models.Token{UserID: userId}, req)
+		assert.NoError(t, err)
+		return req.Header.Get("Authorization")
+	}
+	first := inject("1")
+	assert.Equal(t, first, inject("1"))
+	assert.NotEqual(t, first, inject("2"))
+}
+
+// BenchmarkGenerateLNDHubAccessToken signs a token for every request, like the gateway used to.
+func BenchmarkGenerateLNDHubAccessToken(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		_, err := service.GenerateLNDHubAccessToken([]byte("secret"), 60, strconv.Itoa(i%100))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkInjectJWTAccessToken reuses the token of each of 100 users.
+func BenchmarkInjectJWTAccessToken(b *testing.B) {
+	svc := &service.Service{Config: &service.Config{JWTSecret: []byte("secret")}}
+	req, err := http.NewRequest(http.MethodGet, "/balance", nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	tokens := []*models.Token{}
+	for i := 0; i < 100; i++ {
+		tokens = append(tokens, &models.Token{UserID: strconv.Itoa(i)})
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err = svc.InjectJWTAccessToken(tokens[i%100], req)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestRequestValidation(t *testing.T) {
+	originCalls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		originCalls++
+		//the body is still proxied after it was validated
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, `{"amount": 100}`, string(body))
+	}))
+	defer ts.Close()
+	svc, _, _, token := initGatewayTest(t, fmt.Sprintf(`[{
+		"matchRoute": "/invoices", "origin": "%s", "description": "Create invoices on your behalf.", "scope": "invoices:create", "maxBodyBytes": 64,
+		"requestSchema": {"type": "object", "required": ["amount"], "properties": {"amount": {"type": "integer"}, "description": {"type": "string"}}}
+	}]`, ts.URL), "invoices:create")
+
+	doRequest := func(body string) *httptest.ResponseRecorder {
+		return gatewayRequest(t, svc, token.GetAccess(), http.MethodPost, "/invoices", body)
+	}
+	rec := doRequest(`{"amount": 100}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, 1, originCalls)
+
+	rec = doRequest(`{"amount": "100", "description": 1}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, "application/problem+json", rec.Header().Get("Content-Type"))
+	resp := struct {
+		Fields []struct {
+			Field string `json:"field"`
+		} `json:"errors"`
+	}{}
+	err := json.NewDecoder(rec.Body).Decode(&resp)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(resp.Fields))
+	assert.Equal(t, "/amount", resp.Fields[0].Field)
+	assert.Equal(t, "/description", resp.Fields[1].Field)
+
+	rec = doRequest(fmt.Sprintf(`{"amount": 100, "description": "%s"}`, strings.Repeat("a", 64)))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+	//invalid requests are not sent to the origin
+	assert.Equal(t, 1, originCalls)
+
+	dropGatewayTables(t, svc)
+}
+
+func TestResponseFields(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/user/export" {
+			//not labelled as JSON, so it can't be filtered
+			w.Header().Set("Content-Type", "text/plain")
+			_, err := w.Write([]byte(`{"balance": 1000, "email": "satoshi@example.com"}`))
+			assert.NoError(t, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, err := w.Write([]byte(`{"balance": 1000, "email": "satoshi@example.com", "invoices": [{"amount": 10, "preimage": "abc"}]}`))
+		assert.NoError(t, err)
+	}))
+	defer ts.Close()
+	svc, _, cli, token := initGatewayTest(t, fmt.Sprintf(`[{
+		"matchRoute": "/user/summary", "origin": "%[1]s", "description": "Read your account summary.", "scope": "balance:read",
+		"responseFields": {"balance:read": {"allow": ["balance"]}, "invoices:read": {"deny": ["email", "invoices.preimage"]}}
+	}, {
+		"matchRoute": "/user/export", "origin": "%[1]s", "description": "Read your account summary.", "scope": "balance:read",
+		"responseFields": {"balance:read": {"allow": ["balance"]}}
+	}]`, ts.URL), "balance:read")
+	invoicesToken, err := createToken(svc, cli, "1", "balance:read invoices:read")
+	assert.NoError(t, err)
+
+	rec := gatewayRequest(t, svc, token.GetAccess(), http.MethodGet, "/user/summary", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"balance": 1000}`, rec.Body.String())
+	assert.Equal(t, strconv.Itoa(rec.Body.Len()), rec.Header().Get("Content-Length"))
+	//a field is returned if any scope of the token allows it
+	rec = gatewayRequest(t, svc, invoicesToken.GetAccess(), http.MethodGet, "/user/summary", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"balance": 1000, "invoices": [{"amount": 10}]}`, rec.Body.String())
+	//asking for an event stream does not skip the filters
+	req, err := http.NewRequest(http.MethodGet, "/user/summary", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Accept", "text/event-stream")
+	rec = serveGateway(svc, token.GetAccess(), req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"balance": 1000}`, rec.Body.String())
+	//a response that can't be filtered is not returned
+	rec = gatewayRequest(t, svc, token.GetAccess(), http.MethodGet, "/user/export", "")
+	assert.Equal(t, http.StatusBadGateway, rec.Code)
+	assert.NotContains(t, rec.Body.String(), "satoshi@example.com")
+
+	dropGatewayTables(t, svc)
+}
+
+func TestResponseCache(t *testing.T) {
+	originCalls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		originCalls++
+		_, err := w.Write([]byte(fmt.Sprintf("response %d", originCalls)))
+		assert.NoError(t, err)
+	}))
+	defer ts.Close()
+	svc, _, cli, token1 := initGatewayTest(t, fmt.Sprintf(`[{"matchRoute": "/balance", "origin": "%s", "description": "Read your balance.", "scope": "balance:read", "cache": {"ttl": "1m"}}]`, ts.URL), "balance:read")
+	token2, err := createToken(svc, cli, "2", "balance:read")
+	assert.NoError(t, err)
+
+	doRequest := func(token string) *httptest.ResponseRecorder {
+		return gatewayRequest(t, svc, token, http.MethodGet, "/balance", "")
+	}
+	rec := doRequest(token1.GetAccess())
+	assert.Equal(t, "MISS", rec.Header().Get("X-Cache"))
+	assert.Equal(t, "response 1", rec.Body.String())
+	rec = doRequest(token1.GetAccess())
+	assert.Equal(t, "HIT", rec.Header().Get("X-Cache"))
+	assert.Equal(t, "response 1", rec.Body.String())
+	assert.Equal(t, 1, originCalls)
+	//another user never gets the cached response
+	rec = doRequest(token2.GetAccess())
+	assert.Equal(t, "MISS", rec.Header().Get("X-Cache"))
+	assert.Equal(t, "response 2", rec.Body.String())
+
+	dropGatewayTables(t, svc)
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	var originCalls int32
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count := atomic.AddInt32(&originCalls, 1)
+		if r.URL.Query().Get("slow") != "" {
+			<-release
+		}
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"payment": %d, "request": %s}`, count, body)
+	}))
+	defer ts.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	var slowCalls int32
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&slowCalls, 1)
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+	svc, _, cli, token := initGatewayTest(t, fmt.Sprintf(`{
+		"upstreams": {"%[3]s": {"responseTimeout": "50ms"}},
+		"targets": [
+			{"matchRoute": "/payments/bolt11", "origin": "%[1]s", "description": "Send payments.", "scope": "payments:send", "idempotent": true},
+			{"matchRoute": "/payments/keysend", "origin": "%[2]s", "description": "Send payments.", "scope": "payments:send", "idempotent": true},
+			{"matchRoute": "/payments/onchain", "origin": "%[3]s", "description": "Send payments.", "scope": "payments:send", "idempotent": true}
+		]
+	}`, ts.URL, down.URL, slow.URL), "payments:send")
+	otherToken, err := createToken(svc, cli, "2", "payments:send")
+	assert.NoError(t, err)
+
+	doRequest := func(accessToken, path, key, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		assert.NoError(t, err)
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		return serveGateway(svc, accessToken, req)
+	}
+	rec := doRequest(token.GetAccess(), "/payments/bolt11", "key-1", `{"invoice": "lnbc1"}`)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Equal(t, `{"payment": 1, "request": {"invoice": "lnbc1"}}`, rec.Body.String())
+	assert.Empty(t, rec.Header().Get("Idempotent-Replayed"))
+
+	//a retry gets the same response
+	rec = doRequest(token.GetAccess(), "/payments/bolt11", "key-1", `{"invoice": "lnbc1"}`)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Equal(t, `{"payment": 1, "request": {"invoice": "lnbc1"}}`, rec.Body.String())
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	assert.Equal(t, "true", rec.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&originCalls))
+
+	//the key can't be reused for another request
+	rec = doRequest(token.GetAccess(), "/payments/bolt11", "key-1", `{"invoice": "lnbc2"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+
+	//keys are per user, and requests without a key are not affected
+	rec = doRequest(otherToken.GetAccess(), "/payments/bolt11", "key-1", `{"invoice": "lnbc1"}`)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	rec = doRequest(token.GetAccess(), "/payments/bolt11", "", `{"invoice": "lnbc1"}`)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&originCalls))
+
+	//a concurrent duplicate gets a 409 while the first request is in flight
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- doRequest(token.GetAccess(), "/payments/bolt11?slow=true", "key-2", `{"invoice": "lnbc3"}`)
+	}()
+	for atomic.LoadInt32(&originCalls) < 4 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	rec = doRequest(token.GetAccess(), "/payments/bolt11?slow=true", "key-2", `{"invoice": "lnbc3"}`)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	close(release)
+	rec = <-done
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	rec = doRequest(token.GetAccess(), "/payments/bolt11?slow=true", "key-2", `{"invoice": "lnbc3"}`)
+	assert.Equal(t, "true", rec.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, int32(4), atomic.LoadInt32(&originCalls))
+
+	//requests that never reached the origin are not stored, a retry is sent to the origin again
+	rec = doRequest(token.GetAccess(), "/payments/keysend", "key-3", `{"invoice": "lnbc4"}`)
+	assert.Equal(t, http.StatusBadGateway, rec.Code)
+	rec = doRequest(token.GetAccess(), "/payments/keysend", "key-3", `{"invoice": "lnbc4"}`)
+	assert.Equal(t, http.StatusBadGateway, rec.Code)
+	assert.Empty(t, rec.Header().Get("Idempotent-Replayed"))
+
+	//after a timeout the origin may have processed the request, so it is not sent again
+	rec = doRequest(token.GetAccess(), "/payments/onchain", "key-4", `{"address": "bc1"}`)
+	assert.Equal(t, http.StatusGatewayTimeout, rec.Code)
+	rec = doRequest(token.GetAccess(), "/payments/onchain", "key-4", `{"address": "bc1"}`)
+	assert.Equal(t, http.StatusGatewayTimeout, rec.Code)
+	assert.Equal(t, "true", rec.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&slowCalls))
+
+	dropGatewayTables(t, svc, constants.IdempotencyKeyTableName)
+}
+
+func TestShadowOrigin(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "origin")
+	}))
+	defer ts.Close()
+	shadowCalls := make(chan *http.Request, 10)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		shadowCalls <- r
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer shadow.Close()
+	svc, _, _, token := initGatewayTest(t, fmt.Sprintf(`{
+		"targets": [
+			{"matchRoute": "/balance", "origin": "%[1]s", "shadowOrigin": "%[2]s/v2", "description": "Read your balance.", "scope": "balance:read"},
+			{"matchRoute": "/invoices", "origin": "%[1]s", "shadowOrigin": "%[2]s/v2", "shadowSampleRate": 0, "methods": ["GET", "POST"], "description": "Read your invoices.", "scope": "balance:read"}
+		]
+	}`, ts.URL, shadow.URL), "balance:read")
+
+	doRequest := func(method, path string) *httptest.ResponseRecorder {
+		return gatewayRequest(t, svc, token.GetAccess(), method, path, "")
+	}
+	mismatches := expvar.Get("shadow_status_mismatches").String()
+	//the client gets the response of the origin, the shadow gets a copy with its own JWT
+	rec := doRequest(http.MethodGet, "/balance")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "origin", rec.Body.String())
+	select {
+	case r := <-shadowCalls:
+		assert.Equal(t, "/v2/balance", r.URL.Path)
+		assert.NotEmpty(t, r.Header.Get("Authorization"))
+	case <-time.After(5 * time.Second):
+		t.Fatal("shadow origin was not called")
+	}
+	//the status difference is recorded after both responses
+	assert.Eventually(t, func() bool {
+		before, _ := strconv.Atoi(mismatches)
+		after, _ := strconv.Atoi(expvar.Get("shadow_status_mismatches").String())
+		return after == before+1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	//not sampled, and requests that are not GET or HEAD are never mirrored
+	assert.Equal(t, http.StatusOK, doRequest(http.MethodGet, "/invoices").Code)
+	assert.Equal(t, http.StatusOK, doRequest(http.MethodPost, "/invoices").Code)
+	time.Sleep(100 * time.Millisecond)
+	assert.Empty(t, shadowCalls)
+
+	dropGatewayTables(t, svc)
+}
+
+func TestEventStream(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//the ticket is not sent to the origin
+		assert.Empty(t, r.URL.Query().Get("ticket"))
+		w.Header().Set("Content-Type", "text/event-stream")
+		for {
+			_, err := w.Write([]byte("data: ping\n\n"))
+			if err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+	}))
+	defer ts.Close()
+	svc, controller, _, token := initGatewayTest(t, fmt.Sprintf(`[{"matchRoute": "/events", "origin": "%s", "description": "Receive events.", "scope": "events:read", "streams": true}]`, ts.URL), "events:read")
+	svc.Config.StreamRevalidateSeconds = 1
+	gateway := httptest.NewServer(svc.GatewayHandler())
+	defer gateway.Close()
+
+	//exchange the access token for a ticket
+	req, err := http.NewRequest(http.MethodPost, "/oauth/stream-ticket", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+token.GetAccess())
+	rec := httptest.NewRecorder()
+	http.HandlerFunc(controller.StreamTicketHandler).ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	ticket := struct {
+		Ticket    string `json:"ticket"`
+		ExpiresIn int    `json:"expires_in"`
+	}{}
+	err = json.NewDecoder(rec.Body).Decode(&ticket)
+	assert.NoError(t, err)
+	assert.Equal(t, constants.StreamTicketSeconds, ticket.ExpiresIn)
+
+	openStream := func() *http.Response {
+		req, err := http.NewRequest(http.MethodGet, gateway.URL+"/events?ticket="+ticket.Ticket, nil)
+		assert.NoError(t, err)
+		req.Header.Set("Accept", "text/event-stream")
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		return resp
+	}
+	resp := openStream()
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "data: ping\n", line)
+
+	//a ticket can only be used once
+	second := openStream()
+	second.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, second.StatusCode)
+
+	//revoking the token closes the stream
+	err = svc.OauthServer.Manager.RemoveAccessToken(req.Context(), token.GetAccess())
+	assert.NoError(t, err)
+	closed := make(chan struct{})
+	go func() {
+		for err == nil {
+			_, err = reader.ReadString('\n')
+		}
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream was not closed after the token was revoked")
+	}
+
+	dropGatewayTables(t, svc, constants.StreamTicketTableName)
+}
+
+func TestWebSocketSubprotocol(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//the bearer subprotocol is not sent to the origin
+		assert.Equal(t, "graphql-ws", r.Header.Get("Sec-WebSocket-Protocol"))
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		assert.NoError(t, err)
+		defer conn.Close()
+		_, err = buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		assert.NoError(t, err)
+		assert.NoError(t, buf.Flush())
+	}))
+	defer ts.Close()
+	svc, _, _, token := initGatewayTest(t, fmt.Sprintf(`[
+		{"matchRoute": "/ws", "origin": "%[1]s", "description": "Receive events.", "scope": "events:read", "streams": true},
+		{"matchRoute": "/events", "origin": "%[1]s", "description": "Receive events.", "scope": "events:read"}
+	]`, ts.URL), "events:read")
+	gateway := httptest.NewServer(svc.GatewayHandler())
+	defer gateway.Close()
+
+	req, err := http.NewRequest(http.MethodGet, gateway.URL+"/ws", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Protocol", "bearer."+token.GetAccess()+", graphql-ws")
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	//the origin selected no subprotocol, so the gateway selects the bearer subprotocol the browser offered
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	assert.Equal(t, "bearer."+token.GetAccess(), resp.Header.Get("Sec-WebSocket-Protocol"))
+
+	//targets that don't allow streams reject upgrades
+	req, err = http.NewRequest(http.MethodGet, "/events", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	rec := serveGateway(svc, token.GetAccess(), req)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	dropGatewayTables(t, svc)
+}
@@ -0,0 +1,279 @@
+package integrationtests
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	originCalls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		originCalls++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+	svc, _, _, token := initGatewayTest(t, fmt.Sprintf(`{
+		"upstreams": {
+			"%[1]s": {
+				"retry": {"attempts": 1, "backoff": "1ms"},
+				"circuitBreaker": {"failureThreshold": 3, "openDuration": "1m"}
+			}
+		},
+		"targets": [{"matchRoute": "/balance", "origin": "%[1]s", "description": "Read your balance.", "scope": "balance:read"}]
+	}`, ts.URL), "balance:read")
+
+	doRequest := func() *httptest.ResponseRecorder {
+		return gatewayRequest(t, svc, token.GetAccess(), http.MethodGet, "/balance", "")
+	}
+	//the first request is retried once
+	rec := doRequest()
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, 2, originCalls)
+	//the third failure opens the breaker, the request is not retried anymore
+	rec = doRequest()
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, 3, originCalls)
+	//the origin is not contacted anymore
+	rec = doRequest()
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, 3, originCalls)
+	assert.NotEmpty(t, rec.Header().Get("Retry-After"))
+	assert.Equal(t, "open", svc.UpstreamHealth()[ts.URL].CircuitBreaker)
+
+	dropGatewayTables(t, svc)
+}
+
+func TestCircuitBreakerCancelledProbe(t *testing.T) {
+	const (
+		fail int32 = iota
+		hang
+		succeed
+	)
+	mode := fail
+	arrived := make(chan struct{}, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.LoadInt32(&mode) {
+		case fail:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case hang:
+			arrived <- struct{}{}
+			<-r.Context().Done()
+		}
+	}))
+	defer ts.Close()
+	svc, _, _, token := initGatewayTest(t, fmt.Sprintf(`{
+		"upstreams": {
+			"%[1]s": {"circuitBreaker": {"failureThreshold": 1, "openDuration": "50ms"}}
+		},
+		"targets": [{"matchRoute": "/balance", "origin": "%[1]s", "description": "Read your balance.", "scope": "balance:read"}]
+	}`, ts.URL), "balance:read")
+
+	assert.Equal(t, http.StatusServiceUnavailable, gatewayRequest(t, svc, token.GetAccess(), http.MethodGet, "/balance", "").Code)
+	assert.Equal(t, "open", svc.UpstreamHealth()[ts.URL].CircuitBreaker)
+	time.Sleep(60 * time.Millisecond)
+
+	//the client cancels the probe before the origin responds
+	atomic.StoreInt32(&mode, hang)
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "/balance", nil)
+	assert.NoError(t, err)
+	done := make(chan struct{})
+	go func() {
+		serveGateway(svc, token.GetAccess(), req)
+		close(done)
+	}()
+	<-arrived
+	cancel()
+	<-done
+	//the cancelled probe neither closes the breaker nor resets the failures
+	health := svc.UpstreamHealth()[ts.URL]
+	assert.Equal(t, "half-open", health.CircuitBreaker)
+	assert.Equal(t, 1, health.Failures)
+
+	//the next request is let through as a new probe
+	atomic.StoreInt32(&mode, succeed)
+	assert.Equal(t, http.StatusOK, gatewayRequest(t, svc, token.GetAccess(), http.MethodGet, "/balance", "").Code)
+	assert.Equal(t, "closed", svc.UpstreamHealth()[ts.URL].CircuitBreaker)
+
+	dropGatewayTables(t, svc)
+}
+
+// writeClientCertificate writes a self signed client certificate and its key.
+func writeClientCertificate(t *testing.T, certFile, keyFile, commonName string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return cert
+}
+
+func TestUpstreamTLS(t *testing.T) {
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client.key")
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(writeClientCertificate(t, certFile, keyFile, "gateway-1"))
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//new connection for every request, so the rotated certificate is used
+		w.Header().Set("Connection", "close")
+		fmt.Fprintf(w, "%s %s", r.TLS.ServerName, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	ts.StartTLS()
+	defer ts.Close()
+	//the test server certificate is issued for example.com
+	err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}), 0600)
+	assert.NoError(t, err)
+
+	svc, _, _, token := initGatewayTest(t, fmt.Sprintf(`{
+		"upstreams": {
+			"%[1]s": {
+				"tls": {"caFile": "%[2]s", "certFile": "%[3]s", "keyFile": "%[4]s", "serverName": "example.com", "minVersion": "1.2"}
+			}
+		},
+		"targets": [{"matchRoute": "/balance", "origin": "%[1]s", "description": "Read your balance.", "scope": "balance:read"}]
+	}`, ts.URL, caFile, certFile, keyFile), "balance:read")
+
+	doRequest := func() *httptest.ResponseRecorder {
+		return gatewayRequest(t, svc, token.GetAccess(), http.MethodGet, "/balance", "")
+	}
+	rec := doRequest()
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "example.com gateway-1", rec.Body.String())
+
+	//rotate the client certificate, it is picked up without a reload
+	clientCAs.AddCert(writeClientCertificate(t, certFile, keyFile, "gateway-2"))
+	later := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(certFile, later, later))
+	assert.NoError(t, os.Chtimes(keyFile, later, later))
+	rec = doRequest()
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "example.com gateway-2", rec.Body.String())
+
+	dropGatewayTables(t, svc)
+}
+
+func TestLoadBalancing(t *testing.T) {
+	var calls1, calls2, healthy2 int32 = 0, 0, 1
+	ts1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls1, 1)
+	}))
+	defer ts1.Close()
+	ts2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			if atomic.LoadInt32(&healthy2) == 0 {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			return
+		}
+		atomic.AddInt32(&calls2, 1)
+	}))
+	defer ts2.Close()
+	svc, _, _, token := initGatewayTest(t, fmt.Sprintf(`{
+		"upstreams": {
+			"%[2]s": {"healthCheck": {"path": "/health", "interval": "20ms", "unhealthyThreshold": 1}}
+		},
+		"targets": [{"matchRoute": "/balance", "origins": ["%[1]s", "%[2]s"], "description": "Read your balance.", "scope": "balance:read"}]
+	}`, ts1.URL, ts2.URL), "balance:read")
+
+	doRequests := func(n int) {
+		for i := 0; i < n; i++ {
+			rec := gatewayRequest(t, svc, token.GetAccess(), http.MethodGet, "/balance", "")
+			assert.Equal(t, http.StatusOK, rec.Code)
+		}
+	}
+	//round robin
+	doRequests(10)
+	assert.Equal(t, int32(5), atomic.LoadInt32(&calls1))
+	assert.Equal(t, int32(5), atomic.LoadInt32(&calls2))
+
+	//an unhealthy instance is taken out of rotation
+	atomic.StoreInt32(&healthy2, 0)
+	assert.Eventually(t, func() bool {
+		return svc.UpstreamHealth()[ts2.URL].HealthCheck == "unhealthy"
+	}, time.Second, 10*time.Millisecond)
+	doRequests(10)
+	assert.Equal(t, int32(15), atomic.LoadInt32(&calls1))
+	assert.Equal(t, int32(5), atomic.LoadInt32(&calls2))
+
+	dropGatewayTables(t, svc)
+}
+
+func TestLoadBalancingRetries(t *testing.T) {
+	var okCalls, failingCalls int32
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&okCalls, 1)
+	}))
+	defer ok.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&failingCalls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, "down")
+	}))
+	defer failing.Close()
+	svc, _, _, token := initGatewayTest(t, fmt.Sprintf(`{
+		"upstreams": {
+			"%[1]s": {"retry": {"attempts": 1, "backoff": "1ms"}},
+			"%[2]s": {"retry": {"attempts": 1, "backoff": "1ms"}}
+		},
+		"targets": [
+			{"matchRoute": "/balance", "origins": ["%[1]s", "%[2]s"], "description": "Read your balance.", "scope": "balance:read"},
+			{"matchRoute": "/invoices", "origin": "%[2]s", "description": "Read your invoices.", "scope": "balance:read"}
+		]
+	}`, ok.URL, failing.URL), "balance:read")
+
+	doRequest := func(path string) *httptest.ResponseRecorder {
+		return gatewayRequest(t, svc, token.GetAccess(), http.MethodGet, path, "")
+	}
+	//a failed request is retried on the other instance
+	for i := 0; i < 20; i++ {
+		assert.Equal(t, http.StatusOK, doRequest("/balance").Code)
+	}
+	assert.Equal(t, int32(20), atomic.LoadInt32(&okCalls))
+	//the failing instance is ejected from the pool after 5 failures
+	assert.Equal(t, int32(5), atomic.LoadInt32(&failingCalls))
+	assert.Equal(t, "open", svc.UpstreamHealth()[failing.URL].CircuitBreaker)
+
+	//the ejection does not affect the target that uses the same origin on its own
+	rec := doRequest("/invoices")
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, "down", rec.Body.String())
+
+	dropGatewayTables(t, svc)
+}
@@ -2,16 +2,23 @@ package integrationtests
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"oauth2server/constants"
 	"oauth2server/controllers"
 	"oauth2server/models"
 	"oauth2server/service"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/go-oauth2/oauth2/v4"
 	"github.com/stretchr/testify/assert"
 	"gorm.io/gorm"
 )
@@ -48,6 +55,79 @@ func initService(t *testing.T) (svc *service.Service, controller *controllers.OA
 	svc.OauthServer.SetAuthorizeScopeHandler(controller.AuthorizeScopeHandler)
 	return svc, controller
 }
+
+// initServiceWithTargets initializes the service with a target file that is written to a temporary directory.
+func initServiceWithTargets(t *testing.T, targets string) (svc *service.Service, controller *controllers.OAuthController) {
+	return initServiceWithConfig(t, *testConfig, targets)
+}
+
+// initServiceWithConfig is initServiceWithTargets for a test that needs its own config.
+func initServiceWithConfig(t *testing.T, conf service.Config, targets string) (svc *service.Service, controller *controllers.OAuthController) {
+	conf.TargetFile = filepath.Join(t.TempDir(), "targets.json")
+	err := ioutil.WriteFile(conf.TargetFile, []byte(targets), 0644)
+	assert.NoError(t, err)
+	svc, err = service.InitService(&conf)
+	assert.NoError(t, err)
+	controller = &controllers.OAuthController{
+		Service: svc,
+	}
+	svc.OauthServer.SetUserAuthorizationHandler(controller.UserAuthorizeHandler)
+	svc.OauthServer.SetInternalErrorHandler(controller.InternalErrorHandler)
+	svc.OauthServer.SetAuthorizeScopeHandler(controller.AuthorizeScopeHandler)
+	_, err = svc.InitGateways()
+	assert.NoError(t, err)
+	return svc, controller
+}
+
+// createToken creates an access token directly, without logging in to LNDhub.
+func createToken(svc *service.Service, cli *models.CreateClientResponse, userId, scope string) (oauth2.TokenInfo, error) {
+	return svc.OauthServer.Manager.GenerateAccessToken(context.Background(), oauth2.ClientCredentials, &oauth2.TokenGenerateRequest{
+		ClientID:     cli.ClientId,
+		ClientSecret: cli.ClientSecret,
+		UserID:       userId,
+		Scope:        scope,
+	})
+}
+
+// initGatewayTest initializes the service with the targets, and creates a client
+// with an access token of user 1 for the scope.
+func initGatewayTest(t *testing.T, targets, scope string) (svc *service.Service, controller *controllers.OAuthController, cli *models.CreateClientResponse, token oauth2.TokenInfo) {
+	svc, controller = initServiceWithTargets(t, targets)
+	cli, err := createClient(controller, &testClient)
+	assert.NoError(t, err)
+	token, err = createToken(svc, cli, "1", scope)
+	assert.NoError(t, err)
+	return svc, controller, cli, token
+}
+
+// gatewayRequest sends a request to the gateway with the access token.
+func gatewayRequest(t *testing.T, svc *service.Service, accessToken, method, path, body string) *httptest.ResponseRecorder {
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req, err := http.NewRequest(method, path, reader)
+	assert.NoError(t, err)
+	return serveGateway(svc, accessToken, req)
+}
+
+// serveGateway sends the request to the gateway, with the access token if there is one.
+func serveGateway(svc *service.Service, accessToken string, req *http.Request) *httptest.ResponseRecorder {
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+	rec := httptest.NewRecorder()
+	svc.GatewayHandler().ServeHTTP(rec, req)
+	return rec
+}
+
+// dropGatewayTables deletes the clients, tokens and usage created by a gateway test, and the other tables.
+func dropGatewayTables(t *testing.T, svc *service.Service, tables ...string) {
+	tables = append([]string{constants.ClientTableName, constants.ClientMetadataTableName, constants.TokenTableName, constants.ClientUsageTableName}, tables...)
+	err := dropTables(svc.DB, tables...)
+	assert.NoError(t, err)
+}
+
 func dropTables(db *gorm.DB, tables ...string) error {
 	for _, table := range tables {
 		err := db.Exec(fmt.Sprintf("delete from %s", table)).Error
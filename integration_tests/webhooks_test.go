@@ -0,0 +1,177 @@
+package integrationtests
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"oauth2server/constants"
+	"oauth2server/controllers"
+	"oauth2server/models"
+	"oauth2server/service"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhooks(t *testing.T) {
+	received := make(chan *http.Request, 10)
+	bodies := make(chan []byte, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		received <- r
+		bodies <- body
+	}))
+	defer receiver.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	svc, controller, cli, _ := initGatewayTest(t, `{
+		"targets": [
+			{"matchRoute": "/invoices/incoming", "origin": "http://localhost:3000", "description": "Read your invoices.", "scope": "invoices:read"},
+			{"matchRoute": "/balance", "origin": "http://localhost:3000", "description": "Read your balance.", "scope": "balance:read"}
+		],
+		"webhookEvents": {"invoice.settled": "invoices:read"}
+	}`, "invoices:read balance:read")
+	svc.Config.WebhookIngestSecret = "ingest-secret"
+	//the receivers are plain http servers on localhost
+	svc.Config.WebhookAllowInsecure = true
+	go svc.DeliverWebhooks()
+
+	otherCli, err := createClient(controller, &testClient)
+	assert.NoError(t, err)
+	_, err = createToken(svc, otherCli, "1", "balance:read")
+	assert.NoError(t, err)
+
+	endpoint := createWebhook(t, controller, cli, receiver.URL, "invoice.settled")
+	assert.NotEmpty(t, endpoint.Secret)
+	failingEndpoint := createWebhook(t, controller, cli, failing.URL, "invoice.settled")
+	//the other client does not have the scope of the event
+	createWebhook(t, controller, otherCli, receiver.URL, "invoice.settled")
+
+	ingest := func(secret, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(http.MethodPost, "/internal/events", strings.NewReader(body))
+		assert.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+secret)
+		rec := httptest.NewRecorder()
+		controller.IngestEventHandler(rec, req)
+		return rec
+	}
+	assert.Equal(t, http.StatusUnauthorized, ingest("wrong", `{"id": "evt_1", "type": "invoice.settled", "userId": "1"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, ingest("ingest-secret", `{"id": "evt_1", "type": "unknown", "userId": "1"}`).Code)
+	rec := ingest("ingest-secret", `{"id": "evt_1", "type": "invoice.settled", "userId": "1", "data": {"payment_hash": "abc"}}`)
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"deliveries":2`)
+	//the same event is not delivered twice
+	rec = ingest("ingest-secret", `{"id": "evt_1", "type": "invoice.settled", "userId": "1", "data": {"payment_hash": "abc"}}`)
+	assert.Contains(t, rec.Body.String(), `"deliveries":0`)
+
+	select {
+	case r := <-received:
+		body := <-bodies
+		assert.Equal(t, "evt_1", r.Header.Get("X-Webhook-Id"))
+		assert.Equal(t, "invoice.settled", r.Header.Get("X-Webhook-Event"))
+		assert.Equal(t, service.SignWebhook(endpoint.Secret, r.Header.Get("X-Webhook-Timestamp"), body), r.Header.Get("X-Webhook-Signature"))
+		payload := map[string]interface{}{}
+		assert.NoError(t, json.Unmarshal(body, &payload))
+		assert.Equal(t, "1", payload["userId"])
+		assert.Equal(t, map[string]interface{}{"payment_hash": "abc"}, payload["data"])
+	case <-time.After(10 * time.Second):
+		t.Fatal("webhook was not delivered")
+	}
+	select {
+	case <-received:
+		t.Fatal("webhook delivered to a client without the scope")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	//the failed delivery is retried later
+	deliveries := []models.WebhookDelivery{}
+	assert.Eventually(t, func() bool {
+		deliveries = webhookDeliveries(t, controller, cli, failingEndpoint.ID)
+		return len(deliveries) == 1 && deliveries[0].Attempts == 1
+	}, 10*time.Second, 100*time.Millisecond)
+	assert.Equal(t, service.WebhookStatusPending, deliveries[0].Status)
+	assert.Equal(t, http.StatusInternalServerError, deliveries[0].LastStatusCode)
+	assert.True(t, deliveries[0].NextAttemptAt.After(time.Now()))
+	deliveries = webhookDeliveries(t, controller, cli, endpoint.ID)
+	assert.Equal(t, service.WebhookStatusDelivered, deliveries[0].Status)
+
+	dropGatewayTables(t, svc, constants.WebhookEndpointTableName, constants.WebhookDeliveryTableName)
+}
+
+func TestWebhookAddresses(t *testing.T) {
+	received := make(chan struct{}, 1)
+	receiver := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+	}))
+	defer receiver.Close()
+	svc, controller, cli, _ := initGatewayTest(t, `{
+		"targets": [{"matchRoute": "/invoices/incoming", "origin": "http://localhost:3000", "description": "Read your invoices.", "scope": "invoices:read"}],
+		"webhookEvents": {"invoice.settled": "invoices:read"}
+	}`, "invoices:read")
+	svc.Config.WebhookIngestSecret = "ingest-secret"
+	go svc.DeliverWebhooks()
+
+	//only https urls can be registered
+	body, err := json.Marshal(&models.CreateWebhookRequest{URL: "http://example.com/webhooks", Events: []string{"invoice.settled"}})
+	assert.NoError(t, err)
+	req, err := http.NewRequest(http.MethodPost, "/oauth/webhooks", bytes.NewReader(body))
+	assert.NoError(t, err)
+	req.SetBasicAuth(cli.ClientId, cli.ClientSecret)
+	rec := httptest.NewRecorder()
+	controller.CreateWebhookHandler(rec, req)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	//the receiver resolves to a loopback address, so nothing is sent to it
+	endpoint := createWebhook(t, controller, cli, receiver.URL, "invoice.settled")
+	req, err = http.NewRequest(http.MethodPost, "/internal/events", strings.NewReader(`{"id": "evt_2", "type": "invoice.settled", "userId": "1"}`))
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer ingest-secret")
+	rec = httptest.NewRecorder()
+	controller.IngestEventHandler(rec, req)
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	deliveries := []models.WebhookDelivery{}
+	assert.Eventually(t, func() bool {
+		deliveries = webhookDeliveries(t, controller, cli, endpoint.ID)
+		return len(deliveries) == 1 && deliveries[0].Attempts == 1
+	}, 10*time.Second, 100*time.Millisecond)
+	assert.Contains(t, deliveries[0].LastError, "is not public")
+	assert.Empty(t, received)
+
+	dropGatewayTables(t, svc, constants.WebhookEndpointTableName, constants.WebhookDeliveryTableName)
+}
+
+func createWebhook(t *testing.T, controller *controllers.OAuthController, cli *models.CreateClientResponse, url string, events ...string) *models.WebhookEndpoint {
+	body, err := json.Marshal(&models.CreateWebhookRequest{URL: url, Events: events})
+	assert.NoError(t, err)
+	req, err := http.NewRequest(http.MethodPost, "/oauth/webhooks", bytes.NewReader(body))
+	assert.NoError(t, err)
+	req.SetBasicAuth(cli.ClientId, cli.ClientSecret)
+	rec := httptest.NewRecorder()
+	controller.CreateWebhookHandler(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	endpoint := &models.WebhookEndpoint{}
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(endpoint))
+	return endpoint
+}
+
+func webhookDeliveries(t *testing.T, controller *controllers.OAuthController, cli *models.CreateClientResponse, id uint) []models.WebhookDelivery {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("/oauth/webhooks/%d/deliveries", id), nil)
+	assert.NoError(t, err)
+	req = mux.SetURLVars(req, map[string]string{"webhookId": fmt.Sprint(id)})
+	req.SetBasicAuth(cli.ClientId, cli.ClientSecret)
+	rec := httptest.NewRecorder()
+	controller.ListWebhookDeliveriesHandler(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	result := []models.WebhookDelivery{}
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&result))
+	return result
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"expvar"
 	"fmt"
 	"net/http"
 	"oauth2server/controllers"
@@ -63,15 +64,29 @@ func main() {
 
 	oauthRouter := r.NewRoute().Subrouter()
 	oauthRouter.HandleFunc("/oauth/authorize", controller.AuthorizationHandler)
-	oauthRouter.HandleFunc("/oauth/token", controller.TokenHandler)
+	oauthRouter.Handle("/oauth/token", middleware.CORSMiddleware(svc, []string{http.MethodPost}, true)(http.HandlerFunc(controller.TokenHandler)))
 	oauthRouter.HandleFunc("/oauth/scopes", controller.ScopeHandler)
 	oauthRouter.HandleFunc("/oauth/endpoints", controller.EndpointHandler)
+	oauthRouter.HandleFunc("/oauth/openapi.json", controller.OpenAPIHandler).Methods(http.MethodGet)
+	oauthRouter.HandleFunc("/.well-known/oauth-authorization-server", controller.DiscoveryHandler).Methods(http.MethodGet)
+	oauthRouter.HandleFunc("/oauth/stream-ticket", controller.StreamTicketHandler).Methods(http.MethodPost)
+	//authenticated with the client credentials
+	oauthRouter.HandleFunc("/oauth/webhooks", controller.ListWebhooksHandler).Methods(http.MethodGet)
+	oauthRouter.HandleFunc("/oauth/webhooks", controller.CreateWebhookHandler).Methods(http.MethodPost)
+	oauthRouter.HandleFunc("/oauth/webhooks/{webhookId}", controller.DeleteWebhookHandler).Methods(http.MethodDelete)
+	oauthRouter.HandleFunc("/oauth/webhooks/{webhookId}/deliveries", controller.ListWebhookDeliveriesHandler).Methods(http.MethodGet)
 
 	//these routes should not be publicly accesible
 	oauthRouter.HandleFunc("/admin/clients", controller.CreateClientHandler).Methods(http.MethodPost)
 	oauthRouter.HandleFunc("/admin/clients", controller.ListAllClientsHandler).Methods(http.MethodGet)
 	oauthRouter.HandleFunc("/admin/clients/{clientId}", controller.FetchClientHandler).Methods(http.MethodGet)
 	oauthRouter.HandleFunc("/admin/clients/{clientId}", controller.UpdateClientMetadataHandler).Methods(http.MethodPut)
+	oauthRouter.HandleFunc("/admin/clients/{clientId}/usage", controller.FetchClientUsageHandler).Methods(http.MethodGet)
+	oauthRouter.HandleFunc("/admin/gateway/reload", controller.ReloadGatewaysHandler).Methods(http.MethodPost)
+	oauthRouter.HandleFunc("/admin/health", controller.HealthHandler).Methods(http.MethodGet)
+	oauthRouter.Handle("/admin/metrics", expvar.Handler()).Methods(http.MethodGet)
+	//events from the backend, protected by WEBHOOK_INGEST_SECRET
+	oauthRouter.HandleFunc("/internal/events", controller.IngestEventHandler).Methods(http.MethodPost)
 	oauthRouter.Use(
 		handlers.RecoveryHandler(),
 		func(h http.Handler) http.Handler { return middleware.LoggingMiddleware(h) },
@@ -88,13 +103,18 @@ func main() {
 	)
 
 	//Initialize API gateway
-	gateways, err := svc.InitGateways()
+	_, err = svc.InitGateways()
 	if err != nil {
 		logrus.Fatal(err)
 	}
-
-	for _, gw := range gateways {
-		r.Handle(gw.MatchRoute, middleware.RegisterMiddleware(gw, conf))
+	//the gateway routes can be swapped at runtime,
+	//so they are matched by the gateway itself
+	gatewayMethods := []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+	r.PathPrefix("/").Handler(middleware.RegisterMiddleware(middleware.CORSMiddleware(svc, gatewayMethods, false)(svc.GatewayHandler()), conf))
+	go svc.ReloadGatewaysOnSignal()
+	go svc.DeliverWebhooks()
+	if conf.TargetFileWatchSeconds > 0 {
+		go svc.WatchTargetFile(time.Duration(conf.TargetFileWatchSeconds) * time.Second)
 	}
 
 	logrus.Infof("Server starting on port %d", conf.Port)
@@ -0,0 +1,72 @@
+package middleware
+
+import (
+	"net/http"
+	"oauth2server/service"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// headers set by the gateway that browser apps can read
+var corsExposedHeaders = []string{
+	"RateLimit-Limit",
+	"RateLimit-Remaining",
+	"RateLimit-Reset",
+	"RateLimit-Policy",
+	"Retry-After",
+	"X-Quota-Daily-Limit",
+	"X-Quota-Daily-Remaining",
+	"X-Quota-Daily-Reset",
+	"X-Quota-Monthly-Limit",
+	"X-Quota-Monthly-Remaining",
+	"X-Quota-Monthly-Reset",
+	"X-Cache",
+	"WWW-Authenticate",
+}
+
+// CORSMiddleware allows browsers on the origins of the registered client domains to call the handler.
+// Requests are authenticated with bearer tokens and never with cookies, so credentials are not allowed.
+// On the token endpoint only public clients are allowed, a client secret should never be used in a browser.
+func CORSMiddleware(svc *service.Service, methods []string, tokenEndpoint bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Add("Vary", "Origin")
+			preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+			clientId := ""
+			if tokenEndpoint && !preflight {
+				clientId = r.FormValue("client_id")
+				if id, _, ok := r.BasicAuth(); ok {
+					clientId = id
+				}
+			}
+			allowed, err := svc.CORSOriginAllowed(r.Context(), origin, clientId, tokenEndpoint)
+			if err != nil {
+				logrus.Errorf("Error checking CORS origin %s: %s", origin, err.Error())
+			}
+			if preflight {
+				if allowed {
+					w.Header().Set("Access-Control-Allow-Origin", origin)
+					w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+					if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+						w.Header().Set("Access-Control-Allow-Headers", headers)
+					}
+					w.Header().Set("Access-Control-Max-Age", "600")
+				}
+				//without the allow headers the browser does not send the request
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			if allowed {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
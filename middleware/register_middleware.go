@@ -41,14 +41,27 @@ func LoggingMiddleware(next http.Handler) http.Handler {
 		r = r.WithContext(context.WithValue(r.Context(), "token_info", lti))
 		//this already calls next.ServeHttp
 		m := httpsnoop.CaptureMetrics(next, w, r)
-		entry = entry.WithField("latency", m.Duration.Seconds())
-		entry = entry.WithField("status", m.Code)
+		status := m.Code
+		if lti.Stream != "" {
+			//streams are logged when they are closed, their duration is not a response latency
+			entry = entry.WithField("stream", lti.Stream)
+			entry = entry.WithField("stream_duration", m.Duration.Seconds())
+			if lti.StreamClosedBy != "" {
+				entry = entry.WithField("stream_closed_by", lti.StreamClosedBy)
+			}
+			//the switching protocols response is written on the hijacked connection
+			if lti.Stream == service.StreamWebSocket && status == http.StatusOK {
+				status = http.StatusSwitchingProtocols
+			}
+		} else {
+			entry = entry.WithField("latency", m.Duration.Seconds())
+		}
+		entry = entry.WithField("status", status)
 		entry = entry.WithField("bytes_out", m.Written)
-		tokenInfo := r.Context().Value("token_info")
-		if tokenInfo != nil {
-			logTokenInfo := tokenInfo.(*models.LogTokenInfo)
-			entry = entry.WithField("user_id", logTokenInfo.UserId)
-			entry = entry.WithField("client_id", logTokenInfo.ClientId)
+		entry = entry.WithField("user_id", lti.UserId)
+		entry = entry.WithField("client_id", lti.ClientId)
+		if lti.Cache != "" {
+			entry = entry.WithField("cache", lti.Cache)
 		}
 		entry.Info()
 	})
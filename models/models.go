@@ -1,22 +1,35 @@
 package models
 
 import (
+	"encoding/json"
+	"time"
+
 	"github.com/golang-jwt/jwt"
 	"gorm.io/gorm"
 )
 
 type LogTokenInfo struct {
-	UserId string
+	UserId   string
 	ClientId string
+	//hit or miss, for targets with a response cache
+	Cache string
+	//websocket or sse, for long lived connections
+	Stream string
+	//token_expired or token_revoked if the gateway closed the stream
+	StreamClosedBy string
 }
 
 type ListClientsResponse struct {
-	Domain   string            `json:"domain,omitempty"`
-	ID       string            `json:"id,omitempty"`
-	Name     string            `json:"name,omitempty"`
-	ImageURL string            `json:"imageUrl,omitempty"`
-	URL      string            `json:"url,omitempty"`
-	Scopes   map[string]string `json:"scopes,omitempty"`
+	Domain       string            `json:"domain,omitempty"`
+	ID           string            `json:"id,omitempty"`
+	Name         string            `json:"name,omitempty"`
+	ImageURL     string            `json:"imageUrl,omitempty"`
+	URL          string            `json:"url,omitempty"`
+	Scopes       map[string]string `json:"scopes,omitempty"`
+	DailyQuota   int64             `json:"dailyQuota,omitempty"`
+	MonthlyQuota int64             `json:"monthlyQuota,omitempty"`
+	Trusted      bool              `json:"trusted,omitempty"`
+	ClientNetworkPolicy
 }
 
 type CreateClientRequest struct {
@@ -26,14 +39,42 @@ type CreateClientRequest struct {
 	ImageUrl string `json:"imageUrl"`
 	URL      string `json:"url,omitempty"`
 	Public   bool   `json:"public"`
+	//maximum number of gateway requests per day and month, 0 is unlimited
+	//omitted values are not changed by an update
+	DailyQuota   *int64 `json:"dailyQuota,omitempty" validate:"omitempty,min=0"`
+	MonthlyQuota *int64 `json:"monthlyQuota,omitempty" validate:"omitempty,min=0"`
+	//trusted first party clients can ask for wildcard scopes like invoices:*
+	Trusted *bool `json:"trusted,omitempty"`
+	ClientNetworkPolicy
+}
+
+// ClientNetworkPolicy restricts where the tokens of a client can be used and requested from.
+// Empty lists don't restrict anything. In update requests, omitted lists are not changed.
+type ClientNetworkPolicy struct {
+	//CIDR ranges or single ip addresses
+	AllowedIPs []string `json:"allowedIps,omitempty" gorm:"serializer:json" validate:"omitempty,dive,cidr|ip"`
+	//ISO 3166 country codes
+	AllowedCountries []string `json:"allowedCountries,omitempty" gorm:"serializer:json" validate:"omitempty,dive,iso3166_1_alpha2"`
+	BlockedCountries []string `json:"blockedCountries,omitempty" gorm:"serializer:json" validate:"omitempty,dive,iso3166_1_alpha2"`
 }
 
 type ClientMetaData struct {
 	gorm.Model
-	ClientID string `json:"clientId,omitempty"`
-	Name     string `json:"name"`
-	ImageUrl string `json:"imageUrl"`
-	URL      string `json:"url,omitempty"`
+	ClientID     string `json:"clientId,omitempty"`
+	Name         string `json:"name"`
+	ImageUrl     string `json:"imageUrl"`
+	URL          string `json:"url,omitempty"`
+	DailyQuota   int64  `json:"dailyQuota"`
+	MonthlyQuota int64  `json:"monthlyQuota"`
+	Trusted      bool   `json:"trusted"`
+	ClientNetworkPolicy
+}
+
+// ClientUsage counts the gateway requests of a client in a day (2006-01-02) or a month (2006-01)
+type ClientUsage struct {
+	ClientID string `gorm:"primaryKey"`
+	Period   string `gorm:"primaryKey"`
+	Requests int64
 }
 
 type CreateClientResponse struct {
@@ -42,9 +83,80 @@ type CreateClientResponse struct {
 	ImageUrl     string `json:"imageUrl"`
 	ClientId     string `json:"clientId"`
 	ClientSecret string `json:"clientSecret,omitempty"`
+	DailyQuota   int64  `json:"dailyQuota,omitempty"`
+	MonthlyQuota int64  `json:"monthlyQuota,omitempty"`
+	Trusted      bool   `json:"trusted,omitempty"`
+	ClientNetworkPolicy
 }
 type LNDhubClaims struct {
 	ID        int64 `json:"id"`
 	IsRefresh bool  `json:"isRefresh"`
 	jwt.StandardClaims
 }
+
+type RateLimitBucket struct {
+	Key       string `gorm:"primaryKey"`
+	Tokens    float64
+	Allowed   bool
+	UpdatedAt time.Time `gorm:"index"`
+}
+
+// StreamTicket can be used once instead of an access token to open a websocket or event stream
+type StreamTicket struct {
+	TicketHash string `gorm:"primaryKey"`
+	//id of the access token in the token table
+	TokenID   uint
+	ExpiresAt time.Time `gorm:"index"`
+}
+
+// IdempotencyKey holds the response to a gateway request with an Idempotency-Key header,
+// Status is 0 while the request is in flight
+type IdempotencyKey struct {
+	KeyHash     string `gorm:"primaryKey"`
+	Fingerprint string
+	Status      int
+	Header      string
+	Body        []byte
+	ExpiresAt   time.Time `gorm:"index"`
+}
+
+// WebhookEndpoint is an url of a client that receives events of the given types
+type WebhookEndpoint struct {
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	ClientID   string    `gorm:"index" json:"-"`
+	URL        string    `json:"url"`
+	EventTypes []string  `gorm:"serializer:json" json:"events"`
+	Secret     string    `json:"secret,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+// WebhookDelivery is a single event sent to a webhook endpoint, it is kept as the delivery log
+type WebhookDelivery struct {
+	ID         uint   `gorm:"primaryKey" json:"id"`
+	EndpointID uint   `gorm:"uniqueIndex:idx_webhook_delivery_event" json:"endpointId"`
+	EventID    string `gorm:"uniqueIndex:idx_webhook_delivery_event" json:"eventId"`
+	EventType  string `json:"event"`
+	Payload    string `json:"-"`
+	//pending, delivered or failed
+	Status         string     `gorm:"index:idx_webhook_delivery_due,priority:1" json:"status"`
+	Attempts       int        `json:"attempts"`
+	NextAttemptAt  time.Time  `gorm:"index:idx_webhook_delivery_due,priority:2" json:"nextAttemptAt"`
+	LastStatusCode int        `json:"lastStatusCode,omitempty"`
+	LastError      string     `json:"lastError,omitempty"`
+	DeliveredAt    *time.Time `json:"deliveredAt,omitempty"`
+	CreatedAt      time.Time  `json:"createdAt"`
+}
+
+type CreateWebhookRequest struct {
+	URL    string   `json:"url" validate:"required,url"`
+	Events []string `json:"events" validate:"required,min=1"`
+}
+
+// WebhookEvent is sent to the ingest endpoint by the backend
+type WebhookEvent struct {
+	//optional, events with the same id are only delivered once
+	ID     string          `json:"id"`
+	Type   string          `json:"type" validate:"required"`
+	UserID string          `json:"userId" validate:"required"`
+	Data   json.RawMessage `json:"data"`
+}
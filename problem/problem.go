@@ -0,0 +1,137 @@
+// Package problem writes the errors of the admin, user and client APIs and of the gateway
+// as RFC 7807 application/problem+json responses.
+// The OAuth endpoints keep the error format of RFC 6749, and the access token errors of the gateway the one of RFC 6750.
+package problem
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+)
+
+const ContentType = "application/problem+json"
+
+// Stable error codes, clients should use these instead of the detail message.
+const (
+	CodeInvalidRequest    = "invalid_request"
+	CodeValidationFailed  = "validation_failed"
+	CodeUnauthorized      = "unauthorized"
+	CodeInvalidClient     = "invalid_client"
+	CodeInvalidToken      = "invalid_token"
+	CodeClientNotFound    = "client_not_found"
+	CodeWebhookNotFound   = "webhook_not_found"
+	CodeUnknownEventType  = "unknown_event_type"
+	CodeInvalidTargetFile = "invalid_target_file"
+	CodeInternalError     = "internal_error"
+
+	//gateway
+	CodeRequestNotAllowed    = "request_not_allowed"
+	CodeRateLimited          = "rate_limited"
+	CodeQuotaExceeded        = "quota_exceeded"
+	CodeRequestTooLarge      = "request_too_large"
+	CodeIdempotencyKeyInUse  = "idempotency_key_in_use"
+	CodeIdempotencyKeyReused = "idempotency_key_reused"
+	CodeServiceUnavailable   = "service_unavailable"
+	CodeUpstreamTimeout      = "upstream_timeout"
+	CodeUpstreamError        = "upstream_error"
+)
+
+// FieldError points to a field of the request that is not valid.
+type FieldError struct {
+	Field string `json:"field"`
+	Error string `json:"error"`
+}
+
+// Problem is an error that is shown to the caller.
+// The type is about:blank, so the title is the status text, and the code tells the errors apart.
+type Problem struct {
+	Type     string       `json:"type"`
+	Title    string       `json:"title"`
+	Status   int          `json:"status"`
+	Code     string       `json:"code"`
+	Detail   string       `json:"detail,omitempty"`
+	Instance string       `json:"instance,omitempty"`
+	Errors   []FieldError `json:"errors,omitempty"`
+
+	//internal error that caused the problem, only logged
+	cause error
+}
+
+func New(status int, code, detail string) *Problem {
+	return &Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Code:   code,
+		Detail: detail,
+	}
+}
+
+// Invalid returns a validation_failed problem for the fields.
+func Invalid(fields ...FieldError) *Problem {
+	p := New(http.StatusBadRequest, CodeValidationFailed, "The request is not valid.")
+	p.Errors = fields
+	return p
+}
+
+// Internal returns an internal_error problem that does not show the cause to the caller.
+func Internal(cause error) *Problem {
+	return New(http.StatusInternalServerError, CodeInternalError, "Something went wrong, please try again later.").WithCause(cause)
+}
+
+// WithCause returns a copy of the problem with the internal error that is logged.
+func (p *Problem) WithCause(cause error) *Problem {
+	result := *p
+	result.cause = cause
+	return &result
+}
+
+func (p *Problem) Error() string {
+	if p.cause != nil {
+		return fmt.Sprintf("%s: %s", p.Code, p.cause.Error())
+	}
+	return fmt.Sprintf("%s: %s", p.Code, p.Detail)
+}
+
+func (p *Problem) Unwrap() error {
+	return p.cause
+}
+
+// Write writes the error as problem response.
+// Errors that are not a problem are internal errors, they are logged and reported but not shown to the caller.
+func Write(w http.ResponseWriter, r *http.Request, err error) {
+	p := &Problem{}
+	if !errors.As(err, &p) {
+		p = Internal(err)
+	}
+	response := *p
+	response.Instance = r.URL.Path
+	entry := logrus.WithFields(logrus.Fields{
+		"code":   p.Code,
+		"status": p.Status,
+		"method": r.Method,
+		"uri":    r.URL.Path,
+		"id":     r.Header.Get("X-Request-Id"),
+	})
+	if p.cause != nil {
+		entry = entry.WithError(p.cause)
+	}
+	if p.Status >= http.StatusInternalServerError {
+		entry.Error(p.Detail)
+		if p.cause != nil {
+			sentry.CaptureException(p.cause)
+		}
+	} else {
+		entry.Info(p.Detail)
+	}
+	w.Header().Set("Content-Type", ContentType)
+	w.WriteHeader(p.Status)
+	err = json.NewEncoder(w).Encode(&response)
+	if err != nil {
+		logrus.Error(err)
+	}
+}
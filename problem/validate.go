@@ -0,0 +1,70 @@
+package problem
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+)
+
+var validate = newValidator()
+
+// newValidator returns a validator that names the fields like the json of the request.
+func newValidator() *validator.Validate {
+	v := validator.New()
+	v.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name := strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+	return v
+}
+
+// Validate checks the validate tags of a request struct,
+// it returns a validation_failed problem with the fields that are not valid.
+func Validate(s interface{}) error {
+	err := validate.Struct(s)
+	if err == nil {
+		return nil
+	}
+	validationErrors := validator.ValidationErrors{}
+	if !errors.As(err, &validationErrors) {
+		return Internal(err)
+	}
+	fields := []FieldError{}
+	for _, fe := range validationErrors {
+		fields = append(fields, FieldError{
+			Field: fieldName(fe),
+			Error: fieldMessage(fe),
+		})
+	}
+	return Invalid(fields...)
+}
+
+// fieldName returns the path of the field without the name of the struct,
+// embedded structs have no json name so they are left out as well.
+func fieldName(fe validator.FieldError) string {
+	parts := strings.Split(fe.Namespace(), ".")[1:]
+	result := []string{}
+	for _, part := range parts {
+		if part == "" || (part[0] >= 'A' && part[0] <= 'Z') {
+			continue
+		}
+		result = append(result, part)
+	}
+	return strings.Join(result, ".")
+}
+
+func fieldMessage(fe validator.FieldError) string {
+	if fe.Tag() == "required" {
+		return "is required"
+	}
+	if fe.Param() != "" {
+		return fmt.Sprintf("failed the %s=%s validation", fe.Tag(), fe.Param())
+	}
+	return fmt.Sprintf("failed the %s validation", fe.Tag())
+}
@@ -0,0 +1,185 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	BalanceRoundRobin       = "round_robin"
+	BalanceLeastConnections = "least_connections"
+)
+
+var errNoAvailableOrigin = errors.New("no available origin")
+
+// pool balances the requests of a target over several origins.
+// Origins that fail their health check, or whose circuit breaker is open, are skipped.
+type pool struct {
+	name      string
+	strategy  string
+	instances []*upstream
+	//url of every instance, in the same order
+	urls []*url.URL
+	//circuit breaker of the pool for every instance without a circuit breaker of its own,
+	//so instances that keep failing are ejected without changing the upstream, which other targets may use
+	ejection []*circuitBreaker
+	next     uint32
+	proxy    *httputil.ReverseProxy
+}
+
+func poolKey(origins []string, strategy string) string {
+	return strategy + "|" + strings.Join(origins, ",")
+}
+
+func newPool(instances []*upstream, strategy string) (*pool, error) {
+	p := &pool{
+		name:      strings.Join(upstreamOrigins(instances), ","),
+		strategy:  strategy,
+		instances: instances,
+	}
+	if p.strategy == "" {
+		p.strategy = BalanceRoundRobin
+	}
+	for _, up := range instances {
+		u, err := url.Parse(up.origin)
+		if err != nil {
+			return nil, err
+		}
+		p.urls = append(p.urls, u)
+		var ejection *circuitBreaker
+		if up.breaker == nil {
+			ejection = newCircuitBreaker(up.origin, &CircuitBreakerConfig{})
+		}
+		p.ejection = append(p.ejection, ejection)
+	}
+	//the path is the same for all instances, only the host is changed per request
+	p.proxy = newProxy(p.urls[0], p, func(w http.ResponseWriter, r *http.Request, err error) {
+		handleProxyError(p.name, w, r, err)
+	})
+	return p, nil
+}
+
+func upstreamOrigins(instances []*upstream) []string {
+	result := []string{}
+	for _, up := range instances {
+		result = append(result, up.origin)
+	}
+	return result
+}
+
+func validateLoadBalancing(strategy string) error {
+	switch strategy {
+	case "", BalanceRoundRobin, BalanceLeastConnections:
+		return nil
+	}
+	return fmt.Errorf("unknown loadBalancing %s", strategy)
+}
+
+// pick returns the index of the instance that gets the next request, or -1 if none is available.
+// Instances in skip are only picked if no other instance is available.
+func (p *pool) pick(skip map[int]bool) int {
+	available := []int{}
+	for i := range p.instances {
+		if p.available(i) && !skip[i] {
+			available = append(available, i)
+		}
+	}
+	if len(available) == 0 && len(skip) > 0 {
+		return p.pick(nil)
+	}
+	if len(available) == 0 {
+		return -1
+	}
+	//the counter also spreads requests over instances with the same number of connections
+	start := int(atomic.AddUint32(&p.next, 1))
+	if p.strategy == BalanceRoundRobin {
+		return available[start%len(available)]
+	}
+	best := -1
+	var bestActive int64
+	for n := range available {
+		i := available[(start+n)%len(available)]
+		active := atomic.LoadInt64(&p.instances[i].active)
+		if best == -1 || active < bestActive {
+			best, bestActive = i, active
+		}
+	}
+	return best
+}
+
+func (p *pool) available(i int) bool {
+	return p.instances[i].available() && (p.ejection[i] == nil || p.ejection[i].available())
+}
+
+// RoundTrip sends the request to an available instance.
+// Idempotent requests are retried on another instance, if there is one, with the retry policy of the first instance.
+func (p *pool) RoundTrip(r *http.Request) (*http.Response, error) {
+	i := p.pick(nil)
+	if i == -1 {
+		return nil, errNoAvailableOrigin
+	}
+	attempts := 1
+	retry := p.instances[i].retry
+	if retry != nil && isRetryable(r) {
+		attempts += retry.Attempts
+	}
+	tried := map[int]bool{}
+	for attempt := 1; ; attempt++ {
+		tried[i] = true
+		resp, err := p.send(i, r)
+		if attempt >= attempts || !isUpstreamFailure(r, resp, err) {
+			return resp, err
+		}
+		next := p.pick(tried)
+		if next == -1 {
+			return resp, err
+		}
+		if resp != nil {
+			//discard the response, we are going to make another one
+			_, _ = io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		logrus.WithField("origin", p.instances[i].origin).Warnf("Retrying %s %s on %s after failed attempt %d", r.Method, r.URL.Path, p.instances[next].origin, attempt)
+		select {
+		case <-time.After(retry.backoff() * time.Duration(attempt)):
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
+		}
+		i = next
+	}
+}
+
+// send sends the request to an instance once, the instance itself does not retry it.
+func (p *pool) send(i int, r *http.Request) (*http.Response, error) {
+	out := r.Clone(r.Context())
+	out.URL.Scheme = p.urls[i].Scheme
+	out.URL.Host = p.urls[i].Host
+	up, ejection := p.instances[i], p.ejection[i]
+	if ejection == nil {
+		return up.trackActive(out, up.roundTrip)
+	}
+	return up.trackActive(out, func(r *http.Request) (*http.Response, error) {
+		return ejection.roundTrip(r, up.roundTrip)
+	})
+}
+
+// health returns the state of the circuit breakers of the pool, by origin.
+func (p *pool) health() map[string]UpstreamHealth {
+	result := map[string]UpstreamHealth{}
+	for i, ejection := range p.ejection {
+		if ejection != nil {
+			result[p.instances[i].origin] = ejection.health()
+		}
+	}
+	return result
+}
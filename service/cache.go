@@ -0,0 +1,233 @@
+package service
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-oauth2/oauth2/v4"
+)
+
+// CacheConfig enables caching of the GET responses of a target.
+type CacheConfig struct {
+	TTL Duration `json:"ttl"`
+	//responses larger than this are not cached, defaults to 1 MB
+	MaxEntryBytes int `json:"maxEntryBytes,omitempty"`
+}
+
+const defaultMaxCacheEntryBytes = 1 << 20
+
+func (config *CacheConfig) validate() error {
+	if config.TTL.Duration <= 0 {
+		return fmt.Errorf("cache ttl should be positive")
+	}
+	if config.MaxEntryBytes < 0 {
+		return fmt.Errorf("cache maxEntryBytes can't be negative")
+	}
+	return nil
+}
+
+type cacheEntry struct {
+	key     string
+	status  int
+	header  http.Header
+	body    []byte
+	created time.Time
+	expires time.Time
+}
+
+func (entry *cacheEntry) size() int {
+	size := len(entry.key) + len(entry.body)
+	for k, values := range entry.header {
+		for _, v := range values {
+			size += len(k) + len(v)
+		}
+	}
+	return size
+}
+
+// ResponseCache is an in memory LRU cache of gateway responses,
+// that holds at most maxBytes of responses.
+type ResponseCache struct {
+	maxBytes int
+	mu       sync.Mutex
+	bytes    int
+	entries  map[string]*list.Element
+	lru      *list.List
+}
+
+func NewResponseCache(maxBytes int) *ResponseCache {
+	return &ResponseCache{
+		maxBytes: maxBytes,
+		entries:  map[string]*list.Element{},
+		lru:      list.New(),
+	}
+}
+
+func (c *ResponseCache) get(key string) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, found := c.entries[key]
+	if !found {
+		return nil
+	}
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(elem)
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	return entry
+}
+
+func (c *ResponseCache) set(entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, found := c.entries[entry.key]; found {
+		c.remove(elem)
+	}
+	size := entry.size()
+	if size > c.maxBytes {
+		return
+	}
+	for c.bytes+size > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.bytes += size
+}
+
+func (c *ResponseCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.bytes -= entry.size()
+}
+
+// cacheKey includes the user, so the response of one user is never served to another,
+// and the scope, because responses can be filtered per scope.
+func cacheKey(r *http.Request, tokenInfo oauth2.TokenInfo) string {
+	return fmt.Sprintf("%s|%s|%s|%s%s?%s", tokenInfo.GetUserID(), tokenInfo.GetClientID(), tokenInfo.GetScope(), r.Host, r.URL.Path, r.URL.RawQuery)
+}
+
+// cacheTTL returns how long a response can be cached, respecting the Cache-Control header of the origin.
+func cacheTTL(header http.Header, ttl time.Duration) time.Duration {
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "no-store" || directive == "no-cache" || directive == "private":
+			return 0
+		case strings.HasPrefix(directive, "max-age=") || strings.HasPrefix(directive, "s-maxage="):
+			seconds, err := strconv.Atoi(directive[strings.Index(directive, "=")+1:])
+			if err != nil {
+				return 0
+			}
+			if maxAge := time.Duration(seconds) * time.Second; maxAge < ttl {
+				ttl = maxAge
+			}
+		}
+	}
+	if header.Get("Set-Cookie") != "" {
+		return 0
+	}
+	return ttl
+}
+
+// serveFromCache writes a cached response, if there is one.
+func (origin *OriginServer) serveFromCache(w http.ResponseWriter, r *http.Request, key string) bool {
+	//clients can ask for a fresh response
+	if strings.Contains(strings.ToLower(r.Header.Get("Cache-Control")), "no-cache") {
+		return false
+	}
+	entry := origin.svc.ResponseCache.get(key)
+	if entry == nil {
+		return false
+	}
+	for k, values := range entry.header {
+		w.Header()[k] = append([]string(nil), values...)
+	}
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(entry.created).Seconds())))
+	w.Header().Set("X-Cache", "HIT")
+	w.WriteHeader(entry.status)
+	_, _ = w.Write(entry.body)
+	return true
+}
+
+// cacheRecorder writes the response through, and keeps a copy to be cached.
+type cacheRecorder struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	maxBytes int
+	tooLarge bool
+}
+
+func (rec *cacheRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *cacheRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	if !rec.tooLarge {
+		if rec.body.Len()+len(b) > rec.maxBytes {
+			rec.tooLarge = true
+			rec.body.Reset()
+		} else {
+			rec.body.Write(b)
+		}
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+func (rec *cacheRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (rec *cacheRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// proxyAndCache proxies the request and caches the response if it is allowed to.
+func (origin *OriginServer) proxyAndCache(w http.ResponseWriter, r *http.Request, key string) {
+	maxBytes := origin.Cache.MaxEntryBytes
+	if maxBytes == 0 {
+		maxBytes = defaultMaxCacheEntryBytes
+	}
+	//headers set by the gateway itself, like the rate limit headers, are not cached
+	gatewayHeaders := w.Header().Clone()
+	w.Header().Set("X-Cache", "MISS")
+	rec := &cacheRecorder{ResponseWriter: w, maxBytes: maxBytes}
+	origin.proxy.ServeHTTP(rec, r)
+	if rec.status != http.StatusOK || rec.tooLarge || r.Context().Err() != nil {
+		return
+	}
+	header := w.Header().Clone()
+	header.Del("X-Cache")
+	for k := range gatewayHeaders {
+		header.Del(k)
+	}
+	ttl := cacheTTL(header, origin.Cache.TTL.Duration)
+	if ttl <= 0 {
+		return
+	}
+	now := time.Now()
+	origin.svc.ResponseCache.set(&cacheEntry{
+		key:     key,
+		status:  rec.status,
+		header:  header,
+		body:    rec.body.Bytes(),
+		created: now,
+		expires: now.Add(ttl),
+	})
+}
@@ -0,0 +1,169 @@
+package service
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+type CircuitBreakerConfig struct {
+	//number of consecutive failures after which the breaker opens
+	FailureThreshold int `json:"failureThreshold"`
+	//time the breaker stays open before a single request is let through to probe the origin
+	OpenDuration Duration `json:"openDuration"`
+}
+
+type circuitBreaker struct {
+	origin           string
+	failureThreshold int
+	openDuration     time.Duration
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func newCircuitBreaker(origin string, config *CircuitBreakerConfig) *circuitBreaker {
+	cb := &circuitBreaker{
+		origin:           origin,
+		failureThreshold: config.FailureThreshold,
+		openDuration:     config.OpenDuration.Duration,
+		state:            breakerClosed,
+	}
+	if cb.failureThreshold == 0 {
+		cb.failureThreshold = defaultFailureThreshold
+	}
+	if cb.openDuration == 0 {
+		cb.openDuration = defaultOpenDuration
+	}
+	return cb
+}
+
+// allow reports whether a request can be sent to the origin,
+// and if not, how long the caller should wait before trying again.
+func (cb *circuitBreaker) allow() (retryAfter time.Duration, allowed bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	switch cb.state {
+	case breakerOpen:
+		remaining := cb.openDuration - time.Since(cb.openedAt)
+		if remaining > 0 {
+			return remaining, false
+		}
+		cb.setState(breakerHalfOpen)
+		cb.probing = true
+		return 0, true
+	case breakerHalfOpen:
+		//only one probe at a time
+		if cb.probing {
+			return cb.openDuration, false
+		}
+		cb.probing = true
+		return 0, true
+	}
+	return 0, true
+}
+
+// roundTrip sends the request if the breaker allows it, and records the result.
+func (cb *circuitBreaker) roundTrip(r *http.Request, roundTrip func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	retryAfter, allowed := cb.allow()
+	if !allowed {
+		return nil, &circuitOpenError{retryAfter: retryAfter}
+	}
+	resp, err := roundTrip(r)
+	//a request that was cancelled by the client says nothing about the origin
+	if r.Context().Err() == nil {
+		cb.record(isUpstreamFailure(r, resp, err) || (resp != nil && resp.StatusCode >= http.StatusInternalServerError))
+	} else {
+		cb.cancel()
+	}
+	return resp, err
+}
+
+// cancel lets another probe through if the cancelled request was one, the failures and the state are kept.
+func (cb *circuitBreaker) cancel() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.state == breakerHalfOpen {
+		cb.probing = false
+	}
+}
+
+func (cb *circuitBreaker) record(failed bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.state == breakerHalfOpen {
+		cb.probing = false
+		if failed {
+			cb.open()
+		} else {
+			cb.failures = 0
+			cb.setState(breakerClosed)
+		}
+		return
+	}
+	if !failed {
+		cb.failures = 0
+		return
+	}
+	cb.failures++
+	if cb.state == breakerClosed && cb.failures >= cb.failureThreshold {
+		cb.open()
+	}
+}
+
+func (cb *circuitBreaker) isOpen() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state == breakerOpen
+}
+
+// available reports whether allow would let a request through, without changing the state.
+func (cb *circuitBreaker) available() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	switch cb.state {
+	case breakerOpen:
+		return time.Since(cb.openedAt) >= cb.openDuration
+	case breakerHalfOpen:
+		return !cb.probing
+	}
+	return true
+}
+
+func (cb *circuitBreaker) health() UpstreamHealth {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return UpstreamHealth{
+		CircuitBreaker: cb.state,
+		Failures:       cb.failures,
+	}
+}
+
+func (cb *circuitBreaker) open() {
+	cb.openedAt = time.Now()
+	cb.setState(breakerOpen)
+}
+
+func (cb *circuitBreaker) setState(state string) {
+	if cb.state == state {
+		return
+	}
+	entry := logrus.WithField("origin", cb.origin).WithField("failures", cb.failures)
+	if state == breakerOpen {
+		entry.Warnf("Circuit breaker changed from %s to %s", cb.state, state)
+	} else {
+		entry.Infof("Circuit breaker changed from %s to %s", cb.state, state)
+	}
+	cb.state = state
+}
@@ -0,0 +1,58 @@
+package service
+
+import (
+	"context"
+	"oauth2server/constants"
+	"oauth2server/models"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type clientCacheEntry struct {
+	metadata *models.ClientMetaData
+	expires  time.Time
+}
+
+// ClientMetaData returns the metadata of a client, or nil if there is none.
+// Results are cached for a short time, changes made on other instances
+// are picked up after at most constants.ClientCacheSeconds.
+func (svc *Service) ClientMetaData(ctx context.Context, clientId string) (*models.ClientMetaData, error) {
+	svc.clientCacheMutex.Lock()
+	entry, found := svc.clientCache[clientId]
+	svc.clientCacheMutex.Unlock()
+	if found && time.Now().Before(entry.expires) {
+		return entry.metadata, nil
+	}
+	md := &models.ClientMetaData{}
+	err := svc.DB.WithContext(ctx).First(md, &models.ClientMetaData{ClientID: clientId}).Error
+	if err == gorm.ErrRecordNotFound {
+		md = nil
+	} else if err != nil {
+		return nil, err
+	}
+	svc.clientCacheMutex.Lock()
+	defer svc.clientCacheMutex.Unlock()
+	if svc.clientCache == nil {
+		svc.clientCache = map[string]*clientCacheEntry{}
+	}
+	now := time.Now()
+	//drop expired entries so the cache does not grow with clients that are no longer used
+	for id, entry := range svc.clientCache {
+		if now.After(entry.expires) {
+			delete(svc.clientCache, id)
+		}
+	}
+	svc.clientCache[clientId] = &clientCacheEntry{
+		metadata: md,
+		expires:  now.Add(constants.ClientCacheSeconds * time.Second),
+	}
+	return md, nil
+}
+
+// InvalidateClientMetaData removes a client from the cache after it has been changed.
+func (svc *Service) InvalidateClientMetaData(clientId string) {
+	svc.clientCacheMutex.Lock()
+	defer svc.clientCacheMutex.Unlock()
+	delete(svc.clientCache, clientId)
+}
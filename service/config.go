@@ -6,11 +6,22 @@ type Config struct {
 	DatabaseUri             string `envconfig:"DATABASE_URI" required:"true"`
 	LndHubUrl               string `envconfig:"LNDHUB_URL" required:"true"`
 	TargetFile              string `envconfig:"TARGET_FILE" default:"targets.json"`
+	TargetFileWatchSeconds  int    `envconfig:"TARGET_FILE_WATCH_SECONDS" default:"10"` //0 disables watching
 	SentryDSN               string `envconfig:"SENTRY_DSN"`
 	AccessTokenExpSeconds   int    `envconfig:"ACCESS_EXPIRY_SECONDS" default:"7200"`     //default 2 hours
 	RefreshTokenExpSeconds  int    `envconfig:"REFRESH_EXPIRY_SECONDS" default:"2592000"` //default 30 days
 	DatadogAgentUrl         string `envconfig:"DATADOG_AGENT_URL"`
 	DatabaseMaxConns        int    `envconfig:"DATABASE_MAX_CONNS" default:"10"`
 	DatabaseMaxIdleConns    int    `envconfig:"DATABASE_MAX_IDLE_CONNS" default:"5"`
-	DatabaseConnMaxLifetime int    `envconfig:"DATABASE_CONN_MAX_LIFETIME" default:"1800"` // 30 minutes
+	DatabaseConnMaxLifetime int    `envconfig:"DATABASE_CONN_MAX_LIFETIME" default:"1800"`   // 30 minutes
+	RateLimitStore          string `envconfig:"RATE_LIMIT_STORE" default:"memory"`           // memory or postgres
+	ResponseCacheMaxBytes   int    `envconfig:"RESPONSE_CACHE_MAX_BYTES" default:"67108864"` // 64 MB
+	StreamRevalidateSeconds int    `envconfig:"STREAM_REVALIDATE_SECONDS" default:"30"`      // how often the token of a stream is checked for revocation
+	TokenCacheSize          int    `envconfig:"TOKEN_CACHE_SIZE" default:"10000"`            // 0 disables the access token cache
+	TokenCacheSeconds       int    `envconfig:"TOKEN_CACHE_SECONDS" default:"30"`
+	PublicURL               string `envconfig:"PUBLIC_URL"`                              // url of this server in the OpenAPI document and the discovery metadata, http://localhost:<port> when empty
+	TrustedProxies          string `envconfig:"TRUSTED_PROXIES"`                         // comma separated CIDR ranges of the proxies whose forwarded headers are used
+	WebhookIngestSecret     string `envconfig:"WEBHOOK_INGEST_SECRET"`                   // bearer token of the internal event ingest endpoint, which is disabled when empty
+	IdempotencyKeySeconds   int    `envconfig:"IDEMPOTENCY_KEY_SECONDS" default:"86400"` // how long the response to an Idempotency-Key is kept
+	WebhookAllowInsecure    bool   `envconfig:"WEBHOOK_ALLOW_INSECURE"`                  // allow http webhook urls and private network addresses, for development only
 }
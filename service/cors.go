@@ -0,0 +1,105 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"oauth2server/constants"
+	"strings"
+	"time"
+
+	oauth2gorm "github.com/getAlby/go-oauth2-gorm"
+	"github.com/go-oauth2/oauth2/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// corsClient is a client that registered a domain with a browser origin.
+type corsClient struct {
+	//public clients have no secret, they are the only ones that can use the token endpoint from a browser
+	public bool
+}
+
+type corsOrigins struct {
+	//client id by origin
+	clients map[string]map[string]corsClient
+	expires time.Time
+}
+
+// browserOrigin returns the origin (scheme://host[:port]) that browsers send for pages on this domain.
+func browserOrigin(domain string) string {
+	parsed, err := url.Parse(domain)
+	if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+		return ""
+	}
+	return strings.ToLower(parsed.Scheme + "://" + parsed.Host)
+}
+
+// clientOrigins returns the clients per browser origin, from the domains they registered.
+// Like the client metadata, the result is cached for constants.ClientCacheSeconds.
+func (svc *Service) clientOrigins(ctx context.Context) (map[string]map[string]corsClient, error) {
+	svc.corsMutex.Lock()
+	defer svc.corsMutex.Unlock()
+	if svc.corsOrigins != nil && time.Now().Before(svc.corsOrigins.expires) {
+		return svc.corsOrigins.clients, nil
+	}
+	clients := []oauth2gorm.ClientStoreItem{}
+	err := svc.DB.WithContext(ctx).Table(constants.ClientTableName).Select("id", "secret", "domain").Find(&clients).Error
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]map[string]corsClient{}
+	for _, client := range clients {
+		origin := browserOrigin(client.Domain)
+		if origin == "" {
+			continue
+		}
+		if result[origin] == nil {
+			result[origin] = map[string]corsClient{}
+		}
+		result[origin][client.ID] = corsClient{public: client.Secret == ""}
+	}
+	svc.corsOrigins = &corsOrigins{
+		clients: result,
+		expires: time.Now().Add(constants.ClientCacheSeconds * time.Second),
+	}
+	return result, nil
+}
+
+// InvalidateClientOrigins makes the next CORS check reload the client domains, after a client has been added.
+func (svc *Service) InvalidateClientOrigins() {
+	svc.corsMutex.Lock()
+	defer svc.corsMutex.Unlock()
+	svc.corsOrigins = nil
+}
+
+// CORSOriginAllowed reports whether a browser on origin can call the gateway with a token of clientId,
+// or any client if clientId is empty. With publicOnly, only clients without a secret are considered.
+func (svc *Service) CORSOriginAllowed(ctx context.Context, origin, clientId string, publicOnly bool) (bool, error) {
+	origins, err := svc.clientOrigins(ctx)
+	if err != nil {
+		return false, err
+	}
+	for id, client := range origins[strings.ToLower(origin)] {
+		if (clientId == "" || id == clientId) && (client.public || !publicOnly) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// checkCORSClient removes the CORS headers if the origin of the request is not a domain of the client of the token,
+// so a browser app can only use the tokens of its own client.
+func (origin *OriginServer) checkCORSClient(w http.ResponseWriter, r *http.Request, tokenInfo oauth2.TokenInfo) {
+	browserOrigin := r.Header.Get("Origin")
+	if browserOrigin == "" || w.Header().Get("Access-Control-Allow-Origin") == "" {
+		return
+	}
+	allowed, err := origin.svc.CORSOriginAllowed(r.Context(), browserOrigin, tokenInfo.GetClientID(), false)
+	if err != nil {
+		logrus.Errorf("Error checking CORS origin %s: %s", browserOrigin, err.Error())
+	}
+	if !allowed {
+		w.Header().Del("Access-Control-Allow-Origin")
+		w.Header().Del("Access-Control-Expose-Headers")
+	}
+}
@@ -0,0 +1,263 @@
+package service
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-oauth2/oauth2/v4"
+	"github.com/golang-jwt/jwt"
+)
+
+const (
+	CredentialsLNDhub = "lndhub"
+	CredentialsJWT    = "jwt"
+	CredentialsAPIKey = "apiKey"
+	CredentialsHMAC   = "hmac"
+	CredentialsNone   = "none"
+
+	defaultCredentialExpiry = time.Minute
+)
+
+// CredentialInjector adds the credentials the origin needs to a request.
+// The access token of the client is removed before, it is never sent to the origin.
+type CredentialInjector interface {
+	Inject(r *http.Request, tokenInfo oauth2.TokenInfo) error
+}
+
+// CredentialConfig selects and configures the injector of a target.
+// Secrets are not put in the target file, they are read from the environment variables that are named here.
+type CredentialConfig struct {
+	//lndhub (default), jwt, apiKey, hmac or none
+	Type string `json:"type"`
+	//header that holds the credential, defaults to Authorization for jwt and X-Api-Key for apiKey
+	Header string `json:"header,omitempty"`
+	//jwt: HS256, HS384, HS512, RS256 or ES256
+	Algorithm string `json:"algorithm,omitempty"`
+	Issuer    string `json:"issuer,omitempty"`
+	Audience  string `json:"audience,omitempty"`
+	//jwt: extra claims, "{user_id}", "{client_id}" and "{scope}" are replaced with the values of the access token
+	Claims map[string]string `json:"claims,omitempty"`
+	//jwt: lifetime of the minted token, defaults to 1 minute
+	Expiry Duration `json:"expiry,omitempty"`
+	//environment variable with the HMAC key of jwt or hmac, or the value of apiKey
+	SecretEnv string `json:"secretEnv,omitempty"`
+	//jwt: PEM file with the private key for RS256 and ES256
+	KeyFile string `json:"keyFile,omitempty"`
+}
+
+// newCredentialInjector creates the injector of a target, nil config means the LNDhub JWT.
+func (svc *Service) newCredentialInjector(config *CredentialConfig, origin string) (CredentialInjector, error) {
+	if config == nil || config.Type == "" || config.Type == CredentialsLNDhub {
+		return &lndhubInjector{svc: svc}, nil
+	}
+	switch config.Type {
+	case CredentialsNone:
+		return noCredentials{}, nil
+	case CredentialsAPIKey:
+		secret, err := config.secret()
+		if err != nil {
+			return nil, err
+		}
+		header := config.Header
+		if header == "" {
+			header = "X-Api-Key"
+		}
+		return &apiKeyInjector{header: header, key: string(secret)}, nil
+	case CredentialsHMAC:
+		secret, err := config.secret()
+		if err != nil {
+			return nil, err
+		}
+		originUrl, err := url.Parse(origin)
+		if err != nil {
+			return nil, err
+		}
+		return &hmacInjector{secret: secret, originPath: originUrl.Path}, nil
+	case CredentialsJWT:
+		return config.newJWTInjector()
+	}
+	return nil, fmt.Errorf("unknown credentials type %s", config.Type)
+}
+
+func (config *CredentialConfig) secret() ([]byte, error) {
+	if config.SecretEnv == "" {
+		return nil, fmt.Errorf("secretEnv is required for %s credentials", config.Type)
+	}
+	secret := os.Getenv(config.SecretEnv)
+	if secret == "" {
+		return nil, fmt.Errorf("environment variable %s is not set", config.SecretEnv)
+	}
+	return []byte(secret), nil
+}
+
+func (config *CredentialConfig) newJWTInjector() (CredentialInjector, error) {
+	injector := &jwtInjector{
+		header:   config.Header,
+		issuer:   config.Issuer,
+		audience: config.Audience,
+		claims:   config.Claims,
+		expiry:   config.Expiry.Duration,
+	}
+	if injector.header == "" {
+		injector.header = "Authorization"
+	}
+	if injector.expiry <= 0 {
+		injector.expiry = defaultCredentialExpiry
+	}
+	algorithm := config.Algorithm
+	if algorithm == "" {
+		algorithm = "HS256"
+	}
+	injector.method = jwt.GetSigningMethod(algorithm)
+	var err error
+	switch algorithm {
+	case "HS256", "HS384", "HS512":
+		injector.key, err = config.secret()
+	case "RS256", "ES256":
+		if config.KeyFile == "" {
+			return nil, fmt.Errorf("keyFile is required for %s", algorithm)
+		}
+		var pem []byte
+		pem, err = ioutil.ReadFile(config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if algorithm == "RS256" {
+			injector.key, err = jwt.ParseRSAPrivateKeyFromPEM(pem)
+		} else {
+			injector.key, err = jwt.ParseECPrivateKeyFromPEM(pem)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported jwt algorithm %s", algorithm)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return injector, nil
+}
+
+// lndhubInjector mints the JWT that lndhub.go expects.
+type lndhubInjector struct {
+	svc *Service
+}
+
+func (injector *lndhubInjector) Inject(r *http.Request, tokenInfo oauth2.TokenInfo) error {
+	return injector.svc.InjectJWTAccessToken(tokenInfo, r)
+}
+
+type noCredentials struct{}
+
+func (noCredentials) Inject(r *http.Request, tokenInfo oauth2.TokenInfo) error {
+	return nil
+}
+
+// apiKeyInjector sends the same key with every request.
+type apiKeyInjector struct {
+	header string
+	key    string
+}
+
+func (injector *apiKeyInjector) Inject(r *http.Request, tokenInfo oauth2.TokenInfo) error {
+	r.Header.Set(injector.header, injector.key)
+	return nil
+}
+
+// jwtInjector mints a short lived JWT for the user of the access token.
+type jwtInjector struct {
+	header   string
+	method   jwt.SigningMethod
+	key      interface{}
+	issuer   string
+	audience string
+	claims   map[string]string
+	expiry   time.Duration
+}
+
+func (injector *jwtInjector) Inject(r *http.Request, tokenInfo oauth2.TokenInfo) error {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"sub": tokenInfo.GetUserID(),
+		"iat": now.Unix(),
+		"exp": now.Add(injector.expiry).Unix(),
+	}
+	if injector.issuer != "" {
+		claims["iss"] = injector.issuer
+	}
+	if injector.audience != "" {
+		claims["aud"] = injector.audience
+	}
+	replacer := strings.NewReplacer(
+		"{user_id}", tokenInfo.GetUserID(),
+		"{client_id}", tokenInfo.GetClientID(),
+		"{scope}", tokenInfo.GetScope(),
+	)
+	for name, value := range injector.claims {
+		claims[name] = replacer.Replace(value)
+	}
+	token, err := jwt.NewWithClaims(injector.method, claims).SignedString(injector.key)
+	if err != nil {
+		return err
+	}
+	if injector.header == "Authorization" {
+		token = "Bearer " + token
+	}
+	r.Header.Set(injector.header, token)
+	return nil
+}
+
+// hmacInjector signs the request, so the origin can check that it was sent by the gateway.
+// The signature is the hex encoded HMAC-SHA256 of the timestamp, method, path with query and the SHA256 of the body,
+// separated by newlines.
+type hmacInjector struct {
+	secret     []byte
+	originPath string
+}
+
+func (injector *hmacInjector) Inject(r *http.Request, tokenInfo oauth2.TokenInfo) error {
+	body := []byte{}
+	if r.Body != nil && r.Body != http.NoBody {
+		var err error
+		body, err = io.ReadAll(r.Body)
+		if err != nil {
+			return err
+		}
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	bodyHash := sha256.Sum256(body)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	//the path as it is sent to the origin
+	path := singleJoiningSlash(injector.originPath, r.URL.Path)
+	if r.URL.RawQuery != "" {
+		path += "?" + r.URL.RawQuery
+	}
+	mac := hmac.New(sha256.New, injector.secret)
+	mac.Write([]byte(strings.Join([]string{timestamp, r.Method, path, hex.EncodeToString(bodyHash[:])}, "\n")))
+	r.Header.Set("X-Signature-Timestamp", timestamp)
+	r.Header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+	return nil
+}
+
+// singleJoiningSlash joins paths like httputil.NewSingleHostReverseProxy does.
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
@@ -0,0 +1,246 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-oauth2/oauth2/v4"
+)
+
+// FieldFilter limits the JSON response fields that a scope reveals.
+// Fields are paths like "balance" or "account.email", a path is applied to every element of an array.
+type FieldFilter struct {
+	//only these fields are returned
+	Allow []string `json:"allow,omitempty"`
+	//all fields except these are returned
+	Deny []string `json:"deny,omitempty"`
+	tree fieldTree
+}
+
+// fieldTree holds the paths of a filter, a nil subtree matches the whole field.
+type fieldTree map[string]fieldTree
+
+type responseFiltersKey struct{}
+
+func (filter *FieldFilter) validate() error {
+	if (len(filter.Allow) == 0) == (len(filter.Deny) == 0) {
+		return fmt.Errorf("exactly one of allow and deny should be set")
+	}
+	paths := filter.Allow
+	if len(filter.Deny) > 0 {
+		paths = filter.Deny
+	}
+	filter.tree = fieldTree{}
+	for _, path := range paths {
+		if path == "" {
+			return fmt.Errorf("empty field")
+		}
+		tree := filter.tree
+		parts := strings.Split(path, ".")
+		for i, part := range parts {
+			if part == "" {
+				return fmt.Errorf("invalid field %s", path)
+			}
+			subtree, found := tree[part]
+			if found && subtree == nil {
+				//a parent field is already matched completely
+				break
+			}
+			if i == len(parts)-1 {
+				tree[part] = nil
+				break
+			}
+			if !found {
+				subtree = fieldTree{}
+				tree[part] = subtree
+			}
+			tree = subtree
+		}
+	}
+	return nil
+}
+
+func (filter *FieldFilter) apply(value interface{}) interface{} {
+	if len(filter.Allow) > 0 {
+		return allowFields(value, filter.tree)
+	}
+	return denyFields(value, filter.tree)
+}
+
+func allowFields(value interface{}, tree fieldTree) interface{} {
+	switch v := value.(type) {
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, elem := range v {
+			result[i] = allowFields(elem, tree)
+		}
+		return result
+	case map[string]interface{}:
+		result := map[string]interface{}{}
+		for key, subtree := range tree {
+			field, found := v[key]
+			if !found {
+				continue
+			}
+			switch field.(type) {
+			case []interface{}, map[string]interface{}:
+				if subtree != nil {
+					result[key] = allowFields(field, subtree)
+					continue
+				}
+			default:
+				//nested fields of a value that is not an object are not allowed
+				if subtree != nil {
+					continue
+				}
+			}
+			result[key] = field
+		}
+		return result
+	}
+	return nil
+}
+
+func denyFields(value interface{}, tree fieldTree) interface{} {
+	switch v := value.(type) {
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, elem := range v {
+			result[i] = denyFields(elem, tree)
+		}
+		return result
+	case map[string]interface{}:
+		result := map[string]interface{}{}
+		for key, field := range v {
+			subtree, found := tree[key]
+			if !found {
+				result[key] = field
+				continue
+			}
+			if subtree != nil {
+				result[key] = denyFields(field, subtree)
+			}
+		}
+		return result
+	}
+	return value
+}
+
+// mergeFields merges the results of several filters, so a field is returned if any of them returns it.
+// The filters don't change the length of arrays, so their elements are merged by index.
+func mergeFields(a, b interface{}) interface{} {
+	switch va := a.(type) {
+	case []interface{}:
+		vb, ok := b.([]interface{})
+		if !ok || len(va) != len(vb) {
+			return a
+		}
+		result := make([]interface{}, len(va))
+		for i := range va {
+			result[i] = mergeFields(va[i], vb[i])
+		}
+		return result
+	case map[string]interface{}:
+		vb, ok := b.(map[string]interface{})
+		if !ok {
+			return a
+		}
+		result := map[string]interface{}{}
+		for key, field := range va {
+			result[key] = field
+		}
+		for key, field := range vb {
+			if existing, found := result[key]; found {
+				result[key] = mergeFields(existing, field)
+			} else {
+				result[key] = field
+			}
+		}
+		return result
+	case nil:
+		return b
+	}
+	return a
+}
+
+// responseFilters returns the filters for the scopes of the token, or nil if the response is not filtered.
+func (origin *OriginServer) responseFilters(tokenInfo oauth2.TokenInfo) []*FieldFilter {
+	if len(origin.ResponseFields) == 0 {
+		return nil
+	}
+	result := []*FieldFilter{}
+	for scope := range origin.svc.ExpandScopes(tokenInfo.GetScope()) {
+		if filter, found := origin.ResponseFields[scope]; found {
+			result = append(result, filter)
+		}
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
+
+// filterResponse rewrites the JSON body of the response with the filters of the request, if there are any.
+// A body that can't be filtered is not returned, the client gets a 502 instead.
+func filterResponse(resp *http.Response) error {
+	filters, ok := resp.Request.Context().Value(responseFiltersKey{}).([]*FieldFilter)
+	if !ok {
+		return nil
+	}
+	if resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified || resp.ContentLength == 0 || resp.Request.Method == http.MethodHead {
+		//no body to filter
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json") {
+		//fail closed, the fields that are not allowed could be anywhere in the body
+		return fmt.Errorf("can't filter a response with content type %q", resp.Header.Get("Content-Type"))
+	}
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		//the gateway asks for an unencoded response, so this should not happen
+		return fmt.Errorf("can't filter a response with content encoding %s", encoding)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	err = decoder.Decode(&value)
+	if err != nil {
+		return fmt.Errorf("can't filter invalid JSON response: %s", err.Error())
+	}
+	var filtered interface{}
+	for i, filter := range filters {
+		if i == 0 {
+			filtered = filter.apply(value)
+			continue
+		}
+		filtered = mergeFields(filtered, filter.apply(value))
+	}
+	body, err = json.Marshal(filtered)
+	if err != nil {
+		return err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.Header.Del("ETag")
+	return nil
+}
+
+// withResponseFilters makes the proxy filter the response of the request.
+func withResponseFilters(r *http.Request, filters []*FieldFilter) *http.Request {
+	//ask for an unencoded response, the transport still compresses the connection to the origin itself
+	r.Header.Del("Accept-Encoding")
+	return r.WithContext(context.WithValue(r.Context(), responseFiltersKey{}, filters))
+}
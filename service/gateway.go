@@ -5,13 +5,23 @@ import (
 	"fmt"
 	"net/http"
 	"oauth2server/models"
+	"oauth2server/problem"
+	"regexp"
 	"strings"
 
 	"github.com/getsentry/sentry-go"
 	"github.com/go-oauth2/oauth2/v4/errors"
+	"github.com/gorilla/mux"
+	"github.com/santhosh-tekuri/jsonschema/v5"
 	"github.com/sirupsen/logrus"
 )
 
+// error codes of RFC 6750
+const (
+	BearerErrorInvalidToken      = "invalid_token"
+	BearerErrorInsufficientScope = "insufficient_scope"
+)
+
 var errorResponses = map[string]int{
 	errors.ErrExpiredAccessToken.Error():  http.StatusUnauthorized,
 	errors.ErrExpiredRefreshToken.Error(): http.StatusUnauthorized,
@@ -20,67 +30,265 @@ var errorResponses = map[string]int{
 }
 
 type OriginServer struct {
-	Origin      string `json:"origin,omitempty"`
-	svc         *Service
-	proxy       http.Handler
-	Scope       string `json:"scope"`
-	MatchRoute  string `json:"matchRoute"`
-	Description string `json:"description"`
+	Origin string `json:"origin,omitempty"`
+	//several instances of the origin, instead of Origin
+	Origins []string `json:"origins,omitempty"`
+	//round_robin (default) or least_connections, for Origins
+	LoadBalancing string `json:"loadBalancing,omitempty"`
+	svc           *Service
+	proxy         http.Handler
+	Scope         string `json:"scope"`
+	MatchRoute    string `json:"matchRoute"`
+	Description   string `json:"description"`
+	//host name the route is served on, all hosts when empty
+	Host string `json:"host,omitempty"`
+	//match all paths starting with MatchRoute instead of only MatchRoute itself
+	PathPrefix bool `json:"pathPrefix,omitempty"`
+	//remove this prefix from the path before it is sent to the origin
+	StripPrefix string `json:"stripPrefix,omitempty"`
+	//path sent to the origin instead of the matched path (or matched prefix),
+	//can contain the path variables of MatchRoute, eg. /v2/invoices/{payment_hash}
+	Rewrite string `json:"rewrite,omitempty"`
+	//matches MatchRoute (or the prefix) against the request path
+	pathRegexp *regexp.Regexp
+	rateLimits *RateLimitConfig
+	//cache GET responses of this target
+	Cache *CacheConfig `json:"cache,omitempty"`
+	//methods of the route, all methods are allowed when empty
+	Methods []string `json:"methods,omitempty"`
+	//JSON schema of POST, PUT and PATCH request bodies
+	RequestSchema json.RawMessage `json:"requestSchema,omitempty"`
+	requestSchema *jsonschema.Schema
+	//JSON schema of the successful responses, only used for the OpenAPI document
+	ResponseSchema json.RawMessage `json:"responseSchema,omitempty"`
+	//larger request bodies are rejected, 0 means unlimited
+	MaxBodyBytes int64 `json:"maxBodyBytes,omitempty"`
+	//JSON response fields per scope, a response is only filtered for tokens with a scope in here
+	ResponseFields map[string]*FieldFilter `json:"responseFields,omitempty"`
+	//inbound headers that are forwarded to the origin
+	Headers *HeaderPolicy `json:"headers,omitempty"`
+	//credentials that are sent to the origin, defaults to the LNDhub JWT
+	Credentials *CredentialConfig `json:"credentials,omitempty"`
+	credentials CredentialInjector
+	//POST, PUT, PATCH and DELETE requests with an Idempotency-Key header are only sent to the origin once
+	Idempotent bool `json:"idempotent,omitempty"`
+	//WebSocket upgrades and event streams are only proxied on targets that allow them
+	Streams bool `json:"streams,omitempty"`
+	//origin that gets a copy of the GET and HEAD requests, its responses are only compared with the origin
+	ShadowOrigin string `json:"shadowOrigin,omitempty"`
+	//share of the requests that is mirrored to the shadow origin, all requests by default
+	ShadowSampleRate  *float64 `json:"shadowSampleRate,omitempty"`
+	shadow            *upstream
+	shadowCredentials CredentialInjector
+	shadowSlots       chan struct{}
+}
+
+// originURLs returns the urls of the instances of the origin.
+func (origin *OriginServer) originURLs() []string {
+	if len(origin.Origins) > 0 {
+		return origin.Origins
+	}
+	return []string{origin.Origin}
 }
 
 func (origin *OriginServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	//check authorization
 	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	stream := streamType(r)
+	if stream != "" && !origin.Streams {
+		if stream == StreamWebSocket {
+			writeErrorResponse(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "This route does not support WebSockets.")
+			return
+		}
+		//an event stream is only a header, the request is handled like any other
+		stream = ""
+	}
+	if token == "" && stream != "" {
+		//browsers can't set headers on websockets and event sources
+		var err error
+		token, r, err = origin.svc.streamAccessToken(r)
+		if err != nil {
+			writeBearerError(w, http.StatusUnauthorized, BearerErrorInvalidToken, err.Error(), "")
+			return
+		}
+	}
+	if token == "" {
+		writeBearerError(w, http.StatusUnauthorized, "", "missing access token", "")
+		return
+	}
 	tokenInfo, err := origin.svc.OauthServer.Manager.LoadAccessToken(r.Context(), token)
 	if err != nil {
 		if status, found := errorResponses[err.Error()]; found {
-			writeErrorResponse(w, err.Error(), status)
+			writeBearerError(w, status, BearerErrorInvalidToken, err.Error(), "")
 		} else {
 			logrus.Errorf("Something went wrong loading access token: %s, token %s, request %v, origin %v", err.Error(), token, r, origin)
 			sentry.CaptureException(err)
-			writeErrorResponse(w, "Something went wrong while authenticating user.", http.StatusInternalServerError)
+			writeErrorResponse(w, r, http.StatusInternalServerError, problem.CodeInternalError, "Something went wrong while authenticating user.")
 		}
 		return
 	}
-	//check scope
-	allowed := false
-	for _, sc := range strings.Split(tokenInfo.GetScope(), " ") {
-		if sc == origin.Scope {
-			allowed = true
-			break
-		}
+	origin.checkCORSClient(w, r, tokenInfo)
+	if !origin.checkClientNetwork(w, r, tokenInfo.GetClientID()) {
+		return
 	}
-	if !allowed {
-		writeErrorResponse(w, fmt.Sprintf("Token does not have the right scope for operation: token scope %s, endpoint scope %s", tokenInfo.GetScope(), origin.Scope), http.StatusUnauthorized)
+	//check scope, taking wildcards and implied scopes into account
+	if !origin.svc.ScopeAllowed(tokenInfo.GetScope(), origin.Scope) {
+		writeBearerError(w, http.StatusForbidden, BearerErrorInsufficientScope, fmt.Sprintf("Token does not have the right scope for operation: token scope %s, endpoint scope %s", tokenInfo.GetScope(), origin.Scope), origin.Scope)
 		return
 	}
 
-	err = origin.svc.InjectJWTAccessToken(tokenInfo, r)
-	if err != nil {
-		logrus.Errorf("Something went wrong generating lndhub token: %s", err.Error())
-		sentry.CaptureException(err)
-		writeErrorResponse(w, "Something went wrong while authenticating user", http.StatusInternalServerError)
+	if !origin.checkRateLimits(w, r, tokenInfo) {
+		writeErrorResponse(w, r, http.StatusTooManyRequests, problem.CodeRateLimited, "Too many requests, please try again later.")
+		return
+	}
+	if !origin.checkQuota(w, r, tokenInfo) {
+		writeErrorResponse(w, r, http.StatusTooManyRequests, problem.CodeQuotaExceeded, "The quota of the client is used up.")
 		return
 	}
 
 	lti := r.Context().Value("token_info")
+	var logTokenInfo *models.LogTokenInfo
 	if lti != nil {
-			logTokenInfo := lti.(*models.LogTokenInfo)
-			logTokenInfo.UserId = tokenInfo.GetUserID()
-			logTokenInfo.ClientId = tokenInfo.GetClientID()
+		logTokenInfo = lti.(*models.LogTokenInfo)
+		logTokenInfo.UserId = tokenInfo.GetUserID()
+		logTokenInfo.ClientId = tokenInfo.GetClientID()
+	}
+
+	cacheable := origin.Cache != nil && origin.svc.ResponseCache != nil && r.Method == http.MethodGet && stream == ""
+	key := ""
+	if cacheable {
+		key = cacheKey(r, tokenInfo)
+		hit := origin.serveFromCache(w, r, key)
+		if logTokenInfo != nil {
+			logTokenInfo.Cache = "miss"
+			if hit {
+				logTokenInfo.Cache = "hit"
+			}
+		}
+		if hit {
+			return
+		}
 	}
 
+	if !origin.validateRequestBody(w, r) {
+		return
+	}
+	//read before the header policy is applied, which could remove it
+	idempotencyKey := r.Header.Get(IdempotencyKeyHeader)
+
+	origin.applyHeaderPolicy(r, tokenInfo, stream)
+
+	origin.rewritePath(r)
+	//the access token of the client is never sent to the origin
+	r.Header.Del("Authorization")
+	err = origin.credentials.Inject(r, tokenInfo)
+	if err != nil {
+		logrus.Errorf("Something went wrong injecting credentials for %s: %s", origin.MatchRoute, err.Error())
+		sentry.CaptureException(err)
+		writeErrorResponse(w, r, http.StatusInternalServerError, problem.CodeInternalError, "Something went wrong while authenticating user.")
+		return
+	}
+	if filters := origin.responseFilters(tokenInfo); filters != nil {
+		r = withResponseFilters(r, filters)
+	}
+	if stream == "" {
+		if mirror := origin.startShadow(r, tokenInfo); mirror != nil {
+			w = mirror.wrap(w)
+			defer mirror.finish()
+		}
+	}
+	if stream != "" {
+		if logTokenInfo != nil {
+			logTokenInfo.Stream = stream
+		}
+		origin.proxyStream(w, r, tokenInfo, logTokenInfo)
+		return
+	}
+	if cacheable {
+		origin.proxyAndCache(w, r, key)
+		return
+	}
+	if origin.Idempotent && idempotencyKey != "" && r.Method != http.MethodGet && r.Method != http.MethodHead {
+		origin.proxyIdempotent(w, r, tokenInfo, idempotencyKey)
+		return
+	}
 	origin.proxy.ServeHTTP(w, r)
 }
 
-func writeErrorResponse(w http.ResponseWriter, msg string, status int) {
-	w.Header().Add("Content-type", "application/json")
+// rewritePath sets the path that will be joined with the origin path.
+func (origin *OriginServer) rewritePath(r *http.Request) {
+	path := r.URL.Path
+	switch {
+	case origin.Rewrite != "":
+		rest := ""
+		if origin.PathPrefix {
+			if loc := origin.pathRegexp.FindStringIndex(path); loc != nil {
+				rest = path[loc[1]:]
+			}
+		}
+		path = origin.Rewrite
+		for name, value := range mux.Vars(r) {
+			path = strings.ReplaceAll(path, fmt.Sprintf("{%s}", name), value)
+		}
+		path += rest
+	case origin.StripPrefix != "":
+		path = strings.TrimPrefix(path, origin.StripPrefix)
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+	default:
+		return
+	}
+	r.URL.Path = path
+	r.URL.RawPath = ""
+}
+
+// writeErrorResponse writes an error of the gateway itself as problem response.
+func writeErrorResponse(w http.ResponseWriter, r *http.Request, status int, code, msg string) {
+	problem.Write(w, r, problem.New(status, code, msg))
+}
+
+// BearerError is the body of the RFC 6750 error responses of the gateway.
+type BearerError struct {
+	Status int `json:"status"`
+	//invalid_token or insufficient_scope, empty if the request had no access token
+	Error            string `json:"error,omitempty"`
+	ErrorDescription string `json:"error_description"`
+	//scope that is needed, for insufficient_scope
+	Scope string `json:"scope,omitempty"`
+}
+
+// writeBearerError writes an error response with an RFC 6750 WWW-Authenticate header,
+// so OAuth client libraries know whether to refresh the token or to ask for consent again.
+func writeBearerError(w http.ResponseWriter, status int, code, description, scope string) {
+	challenge := "Bearer"
+	if code != "" {
+		params := []string{fmt.Sprintf("error=%q", code), fmt.Sprintf("error_description=%q", quotableString(description))}
+		if scope != "" {
+			params = append(params, fmt.Sprintf("scope=%q", scope))
+		}
+		challenge += " " + strings.Join(params, ", ")
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	w.Header().Set("Content-type", "application/json")
 	w.WriteHeader(status)
-	err := json.NewEncoder(w).Encode(map[string]interface{}{
-		"status": status,
-		"error":  msg,
+	err := json.NewEncoder(w).Encode(&BearerError{
+		Status:           status,
+		Error:            code,
+		ErrorDescription: description,
+		Scope:            scope,
 	})
 	if err != nil {
 		logrus.Error(err)
 	}
 }
+
+// quotableString removes the characters that are not allowed in a quoted header value.
+func quotableString(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '"' || r == '\\' || r < 0x20 || r > 0x7e {
+			return -1
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,135 @@
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/go-oauth2/oauth2/v4"
+)
+
+const (
+	HeaderClientId = "X-OAuth-Client-Id"
+	HeaderScopes   = "X-OAuth-Scopes"
+	HeaderUserId   = "X-OAuth-User-Id"
+
+	//all headers with this prefix are set by the gateway, clients can't send them
+	contextHeaderPrefix = "X-Oauth-"
+)
+
+// hopByHopHeaders only apply to a single connection, see RFC 7230 section 6.1.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// requiredHeaders are always forwarded when an allow-list is used, without them the request can't be understood.
+var requiredHeaders = []string{
+	"Accept",
+	"Accept-Encoding",
+	"Content-Encoding",
+	"Content-Length",
+	"Content-Type",
+}
+
+// websocketHeaders are needed to upgrade a connection.
+var websocketHeaders = []string{
+	"Connection",
+	"Upgrade",
+	"Sec-Websocket-Key",
+	"Sec-Websocket-Version",
+	"Sec-Websocket-Protocol",
+	"Sec-Websocket-Extensions",
+}
+
+// HeaderPolicy decides which headers of the client request are forwarded to the origin.
+type HeaderPolicy struct {
+	//only these headers are forwarded
+	Allow []string `json:"allow,omitempty"`
+	//all headers except these are forwarded
+	Deny []string `json:"deny,omitempty"`
+}
+
+func (policy *HeaderPolicy) validate() error {
+	if len(policy.Allow) > 0 && len(policy.Deny) > 0 {
+		return fmt.Errorf("only one of allow and deny can be used")
+	}
+	for _, header := range append(policy.Allow, policy.Deny...) {
+		if strings.HasPrefix(http.CanonicalHeaderKey(header), contextHeaderPrefix) {
+			return fmt.Errorf("header %s is set by the gateway", header)
+		}
+	}
+	return nil
+}
+
+// applyHeaderPolicy removes the headers that should not reach the origin,
+// and sets the context headers that tell the origin which app is calling for which user.
+func (origin *OriginServer) applyHeaderPolicy(r *http.Request, tokenInfo oauth2.TokenInfo, stream string) {
+	removeHopByHopHeaders(r.Header, stream == StreamWebSocket)
+	for key := range r.Header {
+		if strings.HasPrefix(key, contextHeaderPrefix) {
+			r.Header.Del(key)
+		}
+	}
+	if policy := origin.Headers; policy != nil {
+		if len(policy.Allow) > 0 {
+			allowed := map[string]bool{}
+			for _, list := range [][]string{policy.Allow, requiredHeaders} {
+				for _, header := range list {
+					allowed[http.CanonicalHeaderKey(header)] = true
+				}
+			}
+			if stream == StreamWebSocket {
+				for _, header := range websocketHeaders {
+					allowed[header] = true
+				}
+			}
+			for key := range r.Header {
+				if !allowed[key] {
+					r.Header.Del(key)
+				}
+			}
+		}
+		for _, header := range policy.Deny {
+			r.Header.Del(header)
+		}
+	}
+	r.Header.Set(HeaderClientId, tokenInfo.GetClientID())
+	r.Header.Set(HeaderUserId, tokenInfo.GetUserID())
+	//the origin gets the scopes the token gives access to, not the wildcards
+	scopes := []string{}
+	for scope := range origin.svc.ExpandScopes(tokenInfo.GetScope()) {
+		scopes = append(scopes, scope)
+	}
+	sort.Strings(scopes)
+	r.Header.Set(HeaderScopes, strings.Join(scopes, " "))
+}
+
+// removeHopByHopHeaders removes the hop-by-hop headers, including the ones listed in the Connection header.
+// The headers that upgrade the connection are kept for websockets.
+func removeHopByHopHeaders(header http.Header, upgrade bool) {
+	keep := func(name string) bool {
+		name = http.CanonicalHeaderKey(name)
+		return upgrade && (name == "Connection" || name == "Upgrade")
+	}
+	for _, v := range header.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" && !keep(name) {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		if !keep(name) {
+			header.Del(name)
+		}
+	}
+}
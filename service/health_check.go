@@ -0,0 +1,169 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultHealthCheckInterval  = 10 * time.Second
+	defaultHealthCheckTimeout   = 2 * time.Second
+	defaultHealthyThreshold     = 2
+	defaultUnhealthyThreshold   = 2
+	healthCheckStatusHealthy    = "healthy"
+	healthCheckStatusUnhealthy  = "unhealthy"
+	healthCheckMaxResponseBytes = 1 << 16
+)
+
+// HealthCheckConfig enables active health checks of an origin.
+// The origin is healthy when a GET request to Path returns a 2xx response.
+type HealthCheckConfig struct {
+	//path on the host of the origin, defaults to /
+	Path     string   `json:"path,omitempty"`
+	Interval Duration `json:"interval,omitempty"`
+	Timeout  Duration `json:"timeout,omitempty"`
+	//consecutive successful checks after which an unhealthy origin is healthy again
+	HealthyThreshold int `json:"healthyThreshold,omitempty"`
+	//consecutive failed checks after which the origin is unhealthy
+	UnhealthyThreshold int `json:"unhealthyThreshold,omitempty"`
+}
+
+func (config *HealthCheckConfig) validate() error {
+	if config.Path != "" && config.Path[0] != '/' {
+		return fmt.Errorf("health check path should start with /")
+	}
+	if config.Interval.Duration < 0 || config.Timeout.Duration < 0 || config.HealthyThreshold < 0 || config.UnhealthyThreshold < 0 {
+		return fmt.Errorf("health check settings can't be negative")
+	}
+	return nil
+}
+
+type healthChecker struct {
+	url                string
+	interval           time.Duration
+	timeout            time.Duration
+	healthyThreshold   int
+	unhealthyThreshold int
+	client             *http.Client
+	done               chan struct{}
+	stopOnce           sync.Once
+
+	mu        sync.Mutex
+	healthy   bool
+	successes int
+	failures  int
+	lastError string
+}
+
+func newHealthChecker(originUrl *url.URL, config *HealthCheckConfig, transport http.RoundTripper) *healthChecker {
+	checkUrl := url.URL{Scheme: originUrl.Scheme, Host: originUrl.Host, Path: config.Path}
+	if checkUrl.Path == "" {
+		checkUrl.Path = "/"
+	}
+	hc := &healthChecker{
+		url:                checkUrl.String(),
+		interval:           config.Interval.Duration,
+		timeout:            config.Timeout.Duration,
+		healthyThreshold:   config.HealthyThreshold,
+		unhealthyThreshold: config.UnhealthyThreshold,
+		client:             &http.Client{Transport: transport},
+		done:               make(chan struct{}),
+		//origins are healthy until a check says otherwise
+		healthy: true,
+	}
+	if hc.interval == 0 {
+		hc.interval = defaultHealthCheckInterval
+	}
+	if hc.timeout == 0 {
+		hc.timeout = defaultHealthCheckTimeout
+	}
+	if hc.healthyThreshold == 0 {
+		hc.healthyThreshold = defaultHealthyThreshold
+	}
+	if hc.unhealthyThreshold == 0 {
+		hc.unhealthyThreshold = defaultUnhealthyThreshold
+	}
+	return hc
+}
+
+func (hc *healthChecker) run() {
+	ticker := time.NewTicker(hc.interval)
+	defer ticker.Stop()
+	for {
+		hc.record(hc.check())
+		select {
+		case <-hc.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (hc *healthChecker) stop() {
+	hc.stopOnce.Do(func() {
+		close(hc.done)
+	})
+}
+
+func (hc *healthChecker) check() error {
+	ctx, cancel := context.WithTimeout(context.Background(), hc.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, hc.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := hc.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, healthCheckMaxResponseBytes))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("health check returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (hc *healthChecker) record(err error) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if err == nil {
+		hc.failures = 0
+		hc.successes++
+		if !hc.healthy && hc.successes >= hc.healthyThreshold {
+			hc.healthy = true
+			logrus.WithField("origin", hc.url).Infof("Origin is healthy again")
+		}
+		return
+	}
+	hc.lastError = err.Error()
+	hc.successes = 0
+	hc.failures++
+	if hc.healthy && hc.failures >= hc.unhealthyThreshold {
+		hc.healthy = false
+		logrus.WithField("origin", hc.url).Warnf("Origin is unhealthy: %s", err.Error())
+	}
+}
+
+func (hc *healthChecker) isHealthy() bool {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	return hc.healthy
+}
+
+func (hc *healthChecker) status() (status, lastError string) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if hc.healthy {
+		return healthCheckStatusHealthy, hc.lastError
+	}
+	return healthCheckStatusUnhealthy, hc.lastError
+}
@@ -0,0 +1,117 @@
+package service
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// RequestHost returns the host name of a request, without the port.
+func RequestHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	return strings.ToLower(host)
+}
+
+func validateHost(host string) error {
+	if host == "" {
+		return nil
+	}
+	if strings.ContainsAny(host, "/{}:") || host != strings.ToLower(host) {
+		return fmt.Errorf("host should be a lowercase host name without scheme, port or path")
+	}
+	return nil
+}
+
+// IsTargetHost returns true if the host has its own targets.
+func (svc *Service) IsTargetHost(host string) bool {
+	state := svc.currentGateway()
+	if state == nil {
+		return false
+	}
+	_, found := state.hostScopes[host]
+	return found
+}
+
+// HostEndpoints returns the targets that are served on a host: the targets of the host and the targets without host.
+// Hosts without targets of their own get all targets, like before targets had a host.
+func (svc *Service) HostEndpoints(host string) []*OriginServer {
+	endpoints := svc.Endpoints()
+	if !svc.IsTargetHost(host) {
+		return endpoints
+	}
+	result := []*OriginServer{}
+	for _, origin := range endpoints {
+		if origin.Host == "" || origin.Host == host {
+			result = append(result, origin)
+		}
+	}
+	return result
+}
+
+// HostScopes returns the scopes of the targets that are served on a host.
+func (svc *Service) HostScopes(host string) map[string]string {
+	state := svc.currentGateway()
+	if state == nil {
+		return map[string]string{}
+	}
+	if scopes, found := state.hostScopes[host]; found {
+		return scopes
+	}
+	return state.scopes
+}
+
+// hostScopes returns the scope catalog of every host that has targets of its own.
+func hostScopes(endpoints []*OriginServer) map[string]map[string]string {
+	result := map[string]map[string]string{}
+	for _, origin := range endpoints {
+		if origin.Host != "" {
+			result[origin.Host] = map[string]string{}
+		}
+	}
+	for _, origin := range endpoints {
+		for host, scopes := range result {
+			if origin.Host == "" || origin.Host == host {
+				scopes[origin.Scope] = origin.Description
+			}
+		}
+	}
+	return result
+}
+
+// DiscoveryMetadata returns the RFC 8414 authorization server metadata,
+// the issuer is the url of the host the metadata is requested on.
+func (svc *Service) DiscoveryMetadata(baseURL, host string) map[string]interface{} {
+	scopes := []string{}
+	for scope := range svc.HostScopes(host) {
+		scopes = append(scopes, scope)
+	}
+	sort.Strings(scopes)
+	config := svc.OauthServer.Config
+	responseTypes := []string{}
+	for _, responseType := range config.AllowedResponseTypes {
+		responseTypes = append(responseTypes, responseType.String())
+	}
+	grantTypes := []string{}
+	for _, grantType := range config.AllowedGrantTypes {
+		grantTypes = append(grantTypes, grantType.String())
+	}
+	challengeMethods := []string{}
+	for _, method := range config.AllowedCodeChallengeMethods {
+		challengeMethods = append(challengeMethods, method.String())
+	}
+	return map[string]interface{}{
+		"issuer":                                baseURL,
+		"authorization_endpoint":                baseURL + "/oauth/authorize",
+		"token_endpoint":                        baseURL + "/oauth/token",
+		"scopes_supported":                      scopes,
+		"response_types_supported":              responseTypes,
+		"grant_types_supported":                 grantTypes,
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":      challengeMethods,
+	}
+}
@@ -0,0 +1,252 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"oauth2server/models"
+	"oauth2server/problem"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/go-oauth2/oauth2/v4"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const (
+	IdempotencyKeyHeader      = "Idempotency-Key"
+	IdempotentReplayedHeader  = "Idempotent-Replayed"
+	maxIdempotencyKeyLength   = 255
+	maxIdempotentResponseSize = 1 << 20
+	defaultIdempotencyWindow  = 24 * time.Hour
+	//a request that is in flight for longer than this, because the instance handling it went away,
+	//no longer blocks its key
+	idempotencyLockTimeout = 5 * time.Minute
+)
+
+// lockIdempotencyKeyQuery claims a key that is not used yet, or whose response has expired.
+// Nothing is returned when the key is taken.
+const lockIdempotencyKeyQuery = `
+INSERT INTO idempotency_keys AS k (key_hash, fingerprint, status, header, body, expires_at)
+VALUES (@key_hash, @fingerprint, 0, '', NULL, @expires_at)
+ON CONFLICT (key_hash) DO UPDATE SET
+	fingerprint = EXCLUDED.fingerprint,
+	status = 0,
+	header = '',
+	body = NULL,
+	expires_at = EXCLUDED.expires_at
+WHERE k.expires_at < @now
+RETURNING key_hash`
+
+// proxyIdempotent sends the request to the origin only once per client, user and Idempotency-Key.
+// Retries get the stored response, or a 409 while the first request is still in flight.
+func (origin *OriginServer) proxyIdempotent(w http.ResponseWriter, r *http.Request, tokenInfo oauth2.TokenInfo, key string) {
+	if len(key) > maxIdempotencyKeyLength {
+		writeErrorResponse(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, fmt.Sprintf("Idempotency-Key can't be longer than %d characters.", maxIdempotencyKeyLength))
+		return
+	}
+	fingerprint, err := requestFingerprint(r)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Error reading the request body.")
+		return
+	}
+	keyHash := idempotencyKeyHash(tokenInfo, key)
+	locked, err := origin.svc.lockIdempotencyKey(r.Context(), keyHash, fingerprint)
+	if err != nil {
+		logrus.Errorf("Something went wrong locking idempotency key for %s: %s", origin.MatchRoute, err.Error())
+		sentry.CaptureException(err)
+		writeErrorResponse(w, r, http.StatusInternalServerError, problem.CodeInternalError, "Something went wrong while processing the request.")
+		return
+	}
+	if !locked {
+		origin.svc.replayIdempotentResponse(w, r, keyHash, fingerprint)
+		return
+	}
+	//the request is finished even if the client goes away, so the response is there for its retry
+	r = r.WithContext(detachedContext{r.Context()})
+	rec := &idempotencyRecorder{ResponseWriter: w}
+	//headers set by the gateway itself, like the rate limit headers, are not stored
+	gatewayHeaders := w.Header().Clone()
+	origin.proxy.ServeHTTP(rec, r)
+	header := w.Header().Clone()
+	for k := range gatewayHeaders {
+		header.Del(k)
+	}
+	err = origin.svc.storeIdempotentResponse(keyHash, rec, header)
+	if err != nil {
+		logrus.Errorf("Something went wrong storing idempotent response for %s: %s", origin.MatchRoute, err.Error())
+		sentry.CaptureException(err)
+	}
+}
+
+func (svc *Service) lockIdempotencyKey(ctx context.Context, keyHash, fingerprint string) (locked bool, err error) {
+	now := time.Now()
+	result := []models.IdempotencyKey{}
+	err = svc.DB.WithContext(ctx).Raw(lockIdempotencyKeyQuery, map[string]interface{}{
+		"key_hash":    keyHash,
+		"fingerprint": fingerprint,
+		"expires_at":  now.Add(idempotencyLockTimeout),
+		"now":         now,
+	}).Scan(&result).Error
+	if err != nil {
+		return false, err
+	}
+	return len(result) > 0, nil
+}
+
+func (svc *Service) replayIdempotentResponse(w http.ResponseWriter, r *http.Request, keyHash, fingerprint string) {
+	stored := &models.IdempotencyKey{}
+	err := svc.DB.WithContext(r.Context()).Where("key_hash = ?", keyHash).Take(stored).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		//removed after it expired, the client can try again
+		writeErrorResponse(w, r, http.StatusConflict, problem.CodeIdempotencyKeyInUse, "A request with this Idempotency-Key is already being processed.")
+		return
+	}
+	if err != nil {
+		logrus.Errorf("Something went wrong loading idempotent response: %s", err.Error())
+		sentry.CaptureException(err)
+		writeErrorResponse(w, r, http.StatusInternalServerError, problem.CodeInternalError, "Something went wrong while processing the request.")
+		return
+	}
+	if stored.Fingerprint != fingerprint {
+		writeErrorResponse(w, r, http.StatusUnprocessableEntity, problem.CodeIdempotencyKeyReused, "Idempotency-Key was already used for a different request.")
+		return
+	}
+	if stored.Status == 0 {
+		writeErrorResponse(w, r, http.StatusConflict, problem.CodeIdempotencyKeyInUse, "A request with this Idempotency-Key is already being processed.")
+		return
+	}
+	header := http.Header{}
+	err = json.Unmarshal([]byte(stored.Header), &header)
+	if err != nil {
+		logrus.Errorf("Something went wrong decoding idempotent response: %s", err.Error())
+	}
+	for k, values := range header {
+		w.Header()[k] = values
+	}
+	w.Header().Set(IdempotentReplayedHeader, "true")
+	w.WriteHeader(stored.Status)
+	_, _ = w.Write(stored.Body)
+}
+
+func (svc *Service) storeIdempotentResponse(keyHash string, rec *idempotencyRecorder, header http.Header) error {
+	//the request context is not used, the client may be gone already
+	db := svc.DB.Model(&models.IdempotencyKey{}).Where("key_hash = ?", keyHash)
+	if rec.status == 0 || rec.notSent {
+		//nothing was written, or the request never reached the origin,
+		//so the key is released and a retry is sent to the origin.
+		//Other errors, like timeouts, are stored, as the origin may have processed the request
+		return db.Delete(&models.IdempotencyKey{}).Error
+	}
+	if rec.tooLarge {
+		logrus.Warnf("Idempotent response larger than %d bytes, it is replayed without body", maxIdempotentResponseSize)
+		header.Del("Content-Length")
+		rec.body.Reset()
+	}
+	headerBytes, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	window := defaultIdempotencyWindow
+	if svc.Config.IdempotencyKeySeconds > 0 {
+		window = time.Duration(svc.Config.IdempotencyKeySeconds) * time.Second
+	}
+	return db.Updates(map[string]interface{}{
+		"status":     rec.status,
+		"header":     string(headerBytes),
+		"body":       rec.body.Bytes(),
+		"expires_at": time.Now().Add(window),
+	}).Error
+}
+
+func (svc *Service) cleanupIdempotencyKeys(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		err := svc.DB.Where("expires_at < ?", time.Now()).Delete(&models.IdempotencyKey{}).Error
+		if err != nil {
+			logrus.Errorf("Error removing expired idempotency keys: %s", err.Error())
+		}
+	}
+}
+
+// idempotencyKeyHash scopes the key to the client and the user, so keys of different apps never collide.
+func idempotencyKeyHash(tokenInfo oauth2.TokenInfo, key string) string {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s|%s|%s", tokenInfo.GetClientID(), tokenInfo.GetUserID(), key)))
+	return hex.EncodeToString(hash[:])
+}
+
+// requestFingerprint identifies the request, so a key can't be reused for a different request.
+func requestFingerprint(r *http.Request) (string, error) {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s %s?%s\n", r.Method, r.URL.Path, r.URL.RawQuery)
+	if r.Body != nil && r.Body != http.NoBody {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return "", err
+		}
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		hash.Write(body)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// detachedContext keeps the values of the request context, but is never cancelled.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (deadline time.Time, ok bool) { return }
+func (detachedContext) Done() <-chan struct{}                   { return nil }
+func (detachedContext) Err() error                              { return nil }
+
+// idempotencyRecorder writes the response through and keeps a copy.
+// Write errors are ignored, so the response of the origin is read completely even when the client is gone.
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	tooLarge bool
+	//set when the gateway wrote an error response because the request could not be sent to the origin
+	notSent bool
+}
+
+func (rec *idempotencyRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *idempotencyRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	if !rec.tooLarge {
+		if rec.body.Len()+len(b) > maxIdempotentResponseSize {
+			rec.tooLarge = true
+		} else {
+			rec.body.Write(b)
+		}
+	}
+	_, _ = rec.ResponseWriter.Write(b)
+	return len(b), nil
+}
+
+func (rec *idempotencyRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (rec *idempotencyRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
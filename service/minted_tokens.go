@@ -0,0 +1,57 @@
+package service
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	//lifetime of the LNDhub JWTs minted by the gateway
+	mintedTokenExpirySeconds = 60
+	//a token is not reused when it expires within this time,
+	//so the origin never receives a token that expires while the request is in flight
+	mintedTokenRefreshMargin = 15 * time.Second
+	//when there are more users, expired tokens are removed
+	maxMintedTokens = 10000
+)
+
+type mintedToken struct {
+	token   string
+	expires time.Time
+}
+
+// mintedTokenCache holds the last LNDhub JWT minted per user, the zero value is ready to use.
+type mintedTokenCache struct {
+	mu     sync.Mutex
+	tokens map[string]*mintedToken
+}
+
+func (c *mintedTokenCache) get(userId string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	minted, found := c.tokens[userId]
+	if !found || time.Until(minted.expires) < mintedTokenRefreshMargin {
+		return ""
+	}
+	return minted.token
+}
+
+func (c *mintedTokenCache) set(userId, token string, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.tokens == nil {
+		c.tokens = map[string]*mintedToken{}
+	}
+	if len(c.tokens) >= maxMintedTokens {
+		now := time.Now()
+		for id, minted := range c.tokens {
+			if now.After(minted.expires) {
+				delete(c.tokens, id)
+			}
+		}
+		if len(c.tokens) >= maxMintedTokens {
+			c.tokens = map[string]*mintedToken{}
+		}
+	}
+	c.tokens[userId] = &mintedToken{token: token, expires: expires}
+}
@@ -0,0 +1,177 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"oauth2server/problem"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ParseTrustedProxies parses the comma separated TRUSTED_PROXIES ranges.
+func ParseTrustedProxies(value string) ([]*net.IPNet, error) {
+	ranges := []string{}
+	for _, r := range strings.Split(value, ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			ranges = append(ranges, r)
+		}
+	}
+	return parseCIDRs(ranges)
+}
+
+// parseCIDRs parses CIDR ranges, a single ip address is a range of one address.
+func parseCIDRs(values []string) ([]*net.IPNet, error) {
+	result := []*net.IPNet{}
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip address %s", value)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			result = append(result, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, ipNet)
+	}
+	return result, nil
+}
+
+func containsIP(ranges []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range ranges {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// ClientIP returns the ip address of the client that made the request.
+// The forwarded headers are only used when the request comes from a trusted proxy,
+// otherwise anyone could set them.
+func (svc *Service) ClientIP(r *http.Request) net.IP {
+	ip := remoteIP(r)
+	if ip == nil || !containsIP(svc.trustedProxies, ip) {
+		return ip
+	}
+	if connecting := net.ParseIP(strings.TrimSpace(r.Header.Get("CF-Connecting-IP"))); connecting != nil {
+		return connecting
+	}
+	//the last address that is not a trusted proxy is the client,
+	//addresses before it could have been set by the client itself
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		forwardedIP := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if forwardedIP == nil {
+			break
+		}
+		ip = forwardedIP
+		if !containsIP(svc.trustedProxies, ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// ClientCountry returns the country code of the request, if it comes from a trusted proxy that sets it.
+func (svc *Service) ClientCountry(r *http.Request) string {
+	ip := remoteIP(r)
+	if ip == nil || !containsIP(svc.trustedProxies, ip) {
+		return ""
+	}
+	return strings.ToUpper(strings.TrimSpace(r.Header.Get("CF-IPCountry")))
+}
+
+// RequestScheme returns the scheme of the request as the client sent it.
+// X-Forwarded-Proto is only used when the request comes from a trusted proxy.
+func (svc *Service) RequestScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	ip := remoteIP(r)
+	if ip == nil || !containsIP(svc.trustedProxies, ip) {
+		return "http"
+	}
+	if proto := strings.ToLower(strings.TrimSpace(r.Header.Get("X-Forwarded-Proto"))); proto == "https" || proto == "http" {
+		return proto
+	}
+	return "http"
+}
+
+// CheckClientNetwork checks the request against the allowed ip ranges and countries of the client.
+// It returns the reason if the request is not allowed.
+func (svc *Service) CheckClientNetwork(ctx context.Context, r *http.Request, clientId string) (reason string, err error) {
+	md, err := svc.ClientMetaData(ctx, clientId)
+	if err != nil {
+		return "", err
+	}
+	if md == nil {
+		return "", nil
+	}
+	if len(md.AllowedIPs) > 0 {
+		ranges, err := parseCIDRs(md.AllowedIPs)
+		if err != nil {
+			return "", fmt.Errorf("invalid allowed ips of client %s: %s", clientId, err.Error())
+		}
+		if ip := svc.ClientIP(r); ip == nil || !containsIP(ranges, ip) {
+			return fmt.Sprintf("ip address %s is not allowed for this client", ip), nil
+		}
+	}
+	if len(md.AllowedCountries) == 0 && len(md.BlockedCountries) == 0 {
+		return "", nil
+	}
+	country := svc.ClientCountry(r)
+	if len(md.AllowedCountries) > 0 && !containsCountry(md.AllowedCountries, country) {
+		if country == "" {
+			return "the country of the request is unknown", nil
+		}
+		return fmt.Sprintf("country %s is not allowed for this client", country), nil
+	}
+	if containsCountry(md.BlockedCountries, country) {
+		return fmt.Sprintf("country %s is not allowed for this client", country), nil
+	}
+	return "", nil
+}
+
+func containsCountry(countries []string, country string) bool {
+	for _, c := range countries {
+		if strings.EqualFold(c, country) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkClientNetwork writes the error response and returns false if the request is not allowed from its network.
+func (origin *OriginServer) checkClientNetwork(w http.ResponseWriter, r *http.Request, clientId string) bool {
+	reason, err := origin.svc.CheckClientNetwork(r.Context(), r, clientId)
+	if err != nil {
+		//fail closed, the restrictions are a security feature
+		logrus.Errorf("Error checking network restrictions of client %s: %s", clientId, err.Error())
+		writeErrorResponse(w, r, http.StatusInternalServerError, problem.CodeInternalError, "Something went wrong while authenticating user.")
+		return false
+	}
+	if reason != "" {
+		writeErrorResponse(w, r, http.StatusForbidden, problem.CodeRequestNotAllowed, fmt.Sprintf("Request not allowed: %s", reason))
+		return false
+	}
+	return true
+}
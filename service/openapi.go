@@ -0,0 +1,228 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"oauth2server/problem"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+const OpenAPISecurityScheme = "oauth2"
+
+var validMethods = map[string]bool{
+	http.MethodGet:    true,
+	http.MethodHead:   true,
+	http.MethodPost:   true,
+	http.MethodPut:    true,
+	http.MethodPatch:  true,
+	http.MethodDelete: true,
+}
+
+// bearerErrorSchema describes the RFC 6750 access token errors of the gateway, see BearerError.
+var bearerErrorSchema = map[string]interface{}{
+	"type": "object",
+	"properties": map[string]interface{}{
+		"status":            map[string]interface{}{"type": "integer"},
+		"error":             map[string]interface{}{"type": "string", "enum": []string{BearerErrorInvalidToken, BearerErrorInsufficientScope}},
+		"error_description": map[string]interface{}{"type": "string"},
+		"scope":             map[string]interface{}{"type": "string"},
+	},
+}
+
+// problemSchema describes the RFC 7807 error responses of the gateway.
+var problemSchema = map[string]interface{}{
+	"type": "object",
+	"properties": map[string]interface{}{
+		"type":     map[string]interface{}{"type": "string"},
+		"title":    map[string]interface{}{"type": "string"},
+		"status":   map[string]interface{}{"type": "integer"},
+		"code":     map[string]interface{}{"type": "string"},
+		"detail":   map[string]interface{}{"type": "string"},
+		"instance": map[string]interface{}{"type": "string"},
+		"errors": map[string]interface{}{
+			"type": "array",
+			"items": map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"field": map[string]interface{}{"type": "string"},
+					"error": map[string]interface{}{"type": "string"},
+				},
+			},
+		},
+	},
+}
+
+func validateMethods(methods []string) error {
+	for _, method := range methods {
+		if !validMethods[method] {
+			return fmt.Errorf("invalid method %s", method)
+		}
+	}
+	return nil
+}
+
+// compileResponseSchema only checks that the responseSchema is a valid schema, responses are not validated.
+func (origin *OriginServer) compileResponseSchema() error {
+	if len(origin.ResponseSchema) == 0 {
+		return nil
+	}
+	compiler := jsonschema.NewCompiler()
+	err := compiler.AddResource("responseSchema.json", bytes.NewReader(origin.ResponseSchema))
+	if err == nil {
+		_, err = compiler.Compile("responseSchema.json")
+	}
+	if err != nil {
+		return fmt.Errorf("invalid responseSchema: %s", err.Error())
+	}
+	return nil
+}
+
+// documentedMethods returns the methods of the target, or the one that is most likely when none are set.
+func (origin *OriginServer) documentedMethods() []string {
+	if len(origin.Methods) > 0 {
+		return origin.Methods
+	}
+	if len(origin.RequestSchema) > 0 {
+		return []string{http.MethodPost}
+	}
+	return []string{http.MethodGet}
+}
+
+// OpenAPIDocument describes the gateway routes as an OpenAPI 3.1 document.
+// baseURL is the public url of the server, without a trailing slash.
+func (svc *Service) OpenAPIDocument(baseURL, host string) map[string]interface{} {
+	paths := map[string]map[string]interface{}{}
+	for _, origin := range routeOrder(svc.HostEndpoints(host)) {
+		path, parameters := openAPIPath(origin.MatchRoute)
+		pathItem, found := paths[path]
+		if !found {
+			pathItem = map[string]interface{}{}
+			paths[path] = pathItem
+		}
+		for _, method := range origin.documentedMethods() {
+			method = strings.ToLower(method)
+			//the route that is registered first is the one that matches
+			if _, found := pathItem[method]; found {
+				continue
+			}
+			pathItem[method] = origin.openAPIOperation(method, parameters)
+		}
+	}
+	return map[string]interface{}{
+		"openapi": "3.1.0",
+		"info": map[string]interface{}{
+			"title":   "Alby API",
+			"version": "1.0.0",
+		},
+		"servers": []map[string]interface{}{{"url": baseURL}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"securitySchemes": map[string]interface{}{
+				OpenAPISecurityScheme: map[string]interface{}{
+					"type": "oauth2",
+					"flows": map[string]interface{}{
+						"authorizationCode": map[string]interface{}{
+							"authorizationUrl": baseURL + "/oauth/authorize",
+							"tokenUrl":         baseURL + "/oauth/token",
+							"refreshUrl":       baseURL + "/oauth/token",
+							"scopes":           svc.HostScopes(host),
+						},
+					},
+				},
+			},
+			"schemas": map[string]interface{}{
+				"BearerError": bearerErrorSchema,
+				"Problem":     problemSchema,
+			},
+		},
+	}
+}
+
+func (origin *OriginServer) openAPIOperation(method string, parameters []map[string]interface{}) map[string]interface{} {
+	bearerErrorResponse := func(description string) map[string]interface{} {
+		return map[string]interface{}{
+			"description": description,
+			"headers": map[string]interface{}{
+				"WWW-Authenticate": map[string]interface{}{
+					"description": "The RFC 6750 challenge, with the error, error_description and scope of the body",
+					"schema":      map[string]interface{}{"type": "string"},
+				},
+			},
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{
+					"schema": map[string]interface{}{"$ref": "#/components/schemas/BearerError"},
+				},
+			},
+		}
+	}
+	problemResponse := func(description string) map[string]interface{} {
+		return map[string]interface{}{
+			"description": description,
+			"content": map[string]interface{}{
+				problem.ContentType: map[string]interface{}{
+					"schema": map[string]interface{}{"$ref": "#/components/schemas/Problem"},
+				},
+			},
+		}
+	}
+	success := map[string]interface{}{"description": "Successful response"}
+	if len(origin.ResponseSchema) > 0 {
+		success["content"] = map[string]interface{}{
+			"application/json": map[string]interface{}{"schema": origin.ResponseSchema},
+		}
+	}
+	responses := map[string]interface{}{
+		"200": success,
+		"401": bearerErrorResponse("Missing, invalid or expired access token"),
+		"403": bearerErrorResponse("The access token does not have the scope"),
+		"429": problemResponse("Rate limit or quota exceeded"),
+		"502": problemResponse("The upstream service could not be reached"),
+		"503": problemResponse("The upstream service is temporarily unavailable"),
+		"504": problemResponse("The upstream service did not respond in time"),
+	}
+	operation := map[string]interface{}{
+		"summary":   origin.Description,
+		"security":  []map[string][]string{{OpenAPISecurityScheme: {origin.Scope}}},
+		"responses": responses,
+	}
+	if len(parameters) > 0 {
+		operation["parameters"] = parameters
+	}
+	if len(origin.RequestSchema) > 0 && method != "get" && method != "head" && method != "delete" {
+		responses["400"] = problemResponse("The request body is not valid")
+		operation["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": origin.RequestSchema},
+			},
+		}
+	}
+	if origin.PathPrefix {
+		//OpenAPI has no prefix paths
+		operation["x-path-prefix"] = true
+	}
+	return operation
+}
+
+// openAPIPath converts the mux variables of a route like /invoices/{payment_hash:[0-9a-f]+}
+// to OpenAPI path parameters.
+func openAPIPath(route string) (path string, parameters []map[string]interface{}) {
+	path = rewriteVarRegexp.ReplaceAllStringFunc(route, func(match string) string {
+		parts := strings.SplitN(match[1:len(match)-1], ":", 2)
+		schema := map[string]interface{}{"type": "string"}
+		if len(parts) == 2 {
+			schema["pattern"] = fmt.Sprintf("^%s$", parts[1])
+		}
+		parameters = append(parameters, map[string]interface{}{
+			"name":     parts[0],
+			"in":       "path",
+			"required": true,
+			"schema":   schema,
+		})
+		return fmt.Sprintf("{%s}", parts[0])
+	})
+	return path, parameters
+}
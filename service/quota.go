@@ -0,0 +1,172 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"oauth2server/models"
+	"strconv"
+	"time"
+
+	"github.com/go-oauth2/oauth2/v4"
+	"github.com/sirupsen/logrus"
+)
+
+type QuotaUsage struct {
+	Period string `json:"period"`
+	Used   int64  `json:"used"`
+	//0 means unlimited
+	Limit int64 `json:"limit"`
+	//seconds until the next period starts
+	Reset int64 `json:"reset"`
+}
+
+// available is true if another request can be counted, 0 means unlimited.
+func (q *QuotaUsage) available() bool {
+	return q.Limit == 0 || q.Used < q.Limit
+}
+
+func (q *QuotaUsage) remaining() int64 {
+	if q.Used >= q.Limit {
+		return 0
+	}
+	return q.Limit - q.Used
+}
+
+// usagePeriods returns the keys of the current day and month, and when they end, in UTC.
+func usagePeriods(now time.Time) (day, month string, dayEnd, monthEnd time.Time) {
+	now = now.UTC()
+	day, month = now.Format("2006-01-02"), now.Format("2006-01")
+	dayEnd = time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	monthEnd = time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+	return
+}
+
+// ClientUsage returns the gateway requests of a client in the current day and month.
+func (svc *Service) ClientUsage(ctx context.Context, md *models.ClientMetaData) (daily, monthly *QuotaUsage, err error) {
+	now := time.Now()
+	day, month, dayEnd, monthEnd := usagePeriods(now)
+	usages := []models.ClientUsage{}
+	err = svc.DB.WithContext(ctx).Where("client_id = ? AND period IN ?", md.ClientID, []string{day, month}).Find(&usages).Error
+	if err != nil {
+		return nil, nil, err
+	}
+	daily = &QuotaUsage{Period: day, Limit: md.DailyQuota, Reset: int64(dayEnd.Sub(now).Seconds())}
+	monthly = &QuotaUsage{Period: month, Limit: md.MonthlyQuota, Reset: int64(monthEnd.Sub(now).Seconds())}
+	for _, usage := range usages {
+		switch usage.Period {
+		case day:
+			daily.Used = usage.Requests
+		case month:
+			monthly.Used = usage.Requests
+		}
+	}
+	return daily, monthly, nil
+}
+
+// countUsageQuery counts a request for the day and the month of a client without a quota.
+const countUsageQuery = `
+INSERT INTO client_usages AS u (client_id, period, requests)
+VALUES (@client_id, @day, 1), (@client_id, @month, 1)
+ON CONFLICT (client_id, period) DO UPDATE SET requests = u.requests + 1
+RETURNING client_id, period, requests`
+
+// countLimitedUsageQuery only counts a request for the periods that have not used up their quota,
+// a period that is used up is not returned. A limit of 0 means unlimited.
+const countLimitedUsageQuery = `
+INSERT INTO client_usages AS u (client_id, period, requests)
+VALUES (@client_id, @day, 1), (@client_id, @month, 1)
+ON CONFLICT (client_id, period) DO UPDATE SET requests = u.requests + 1
+WHERE (u.period = @day AND (CAST(@daily_limit AS bigint) = 0 OR u.requests < @daily_limit))
+	OR (u.period = @month AND (CAST(@monthly_limit AS bigint) = 0 OR u.requests < @monthly_limit))
+RETURNING client_id, period, requests`
+
+// refundUsageQuery takes back a request that was counted for a period but rejected by the quota of the other one.
+const refundUsageQuery = `
+UPDATE client_usages
+SET requests = requests - 1
+WHERE client_id = @client_id AND period IN @periods`
+
+// countUsage counts a gateway request of a client.
+// If a quota of the client is used up, the request is not counted and allowed is false.
+func (svc *Service) countUsage(ctx context.Context, md *models.ClientMetaData) (allowed bool, daily, monthly *QuotaUsage, err error) {
+	now := time.Now()
+	day, month, dayEnd, monthEnd := usagePeriods(now)
+	daily = &QuotaUsage{Period: day, Limit: md.DailyQuota, Reset: int64(dayEnd.Sub(now).Seconds())}
+	monthly = &QuotaUsage{Period: month, Limit: md.MonthlyQuota, Reset: int64(monthEnd.Sub(now).Seconds())}
+	query := countUsageQuery
+	if md.DailyQuota > 0 || md.MonthlyQuota > 0 {
+		query = countLimitedUsageQuery
+	}
+	usages := []models.ClientUsage{}
+	err = svc.DB.WithContext(ctx).Raw(query, map[string]interface{}{
+		"client_id":     md.ClientID,
+		"day":           day,
+		"month":         month,
+		"daily_limit":   md.DailyQuota,
+		"monthly_limit": md.MonthlyQuota,
+	}).Scan(&usages).Error
+	if err != nil {
+		return false, nil, nil, err
+	}
+	//a period that was not counted has used up its quota
+	daily.Used, monthly.Used = daily.Limit, monthly.Limit
+	periods := map[string]*QuotaUsage{day: daily, month: monthly}
+	counted := []string{}
+	for _, usage := range usages {
+		periods[usage.Period].Used = usage.Requests
+		counted = append(counted, usage.Period)
+	}
+	if len(counted) == len(periods) {
+		return true, daily, monthly, nil
+	}
+	//the request is rejected, so it is not counted for the other period either
+	if len(counted) > 0 {
+		err = svc.DB.WithContext(ctx).Exec(refundUsageQuery, map[string]interface{}{
+			"client_id": md.ClientID,
+			"periods":   counted,
+		}).Error
+		if err != nil {
+			return false, nil, nil, err
+		}
+		for _, period := range counted {
+			periods[period].Used--
+		}
+	}
+	return false, daily, monthly, nil
+}
+
+// checkQuota counts the request for the client of the token and sets the quota headers.
+// It returns false if a quota of the client is used up.
+// If the usage can't be counted, the request is allowed.
+func (origin *OriginServer) checkQuota(w http.ResponseWriter, r *http.Request, tokenInfo oauth2.TokenInfo) bool {
+	md, err := origin.svc.ClientMetaData(r.Context(), tokenInfo.GetClientID())
+	if err != nil {
+		logrus.Errorf("Error loading client %s for quota check: %s", tokenInfo.GetClientID(), err.Error())
+		return true
+	}
+	if md == nil {
+		return true
+	}
+	allowed, daily, monthly, err := origin.svc.countUsage(r.Context(), md)
+	if err != nil {
+		logrus.Errorf("Error counting usage of client %s: %s", md.ClientID, err.Error())
+		return true
+	}
+	for name, usage := range map[string]*QuotaUsage{"Daily": daily, "Monthly": monthly} {
+		if usage.Limit == 0 {
+			continue
+		}
+		w.Header().Set("X-Quota-"+name+"-Limit", strconv.FormatInt(usage.Limit, 10))
+		w.Header().Set("X-Quota-"+name+"-Remaining", strconv.FormatInt(usage.remaining(), 10))
+		w.Header().Set("X-Quota-"+name+"-Reset", strconv.FormatInt(usage.Reset, 10))
+	}
+	if !allowed {
+		//retry when the longest used up period has ended
+		reset := daily.Reset
+		if monthly.Limit > 0 && monthly.remaining() == 0 {
+			reset = monthly.Reset
+		}
+		w.Header().Set("Retry-After", strconv.FormatInt(reset, 10))
+	}
+	return allowed
+}
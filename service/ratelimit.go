@@ -0,0 +1,250 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-oauth2/oauth2/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// RateLimit is a token bucket that is refilled with Requests tokens every Period,
+// and that can hold at most Burst tokens.
+type RateLimit struct {
+	Requests int      `json:"requests"`
+	Period   Duration `json:"period"`
+	//defaults to Requests
+	Burst int `json:"burst,omitempty"`
+}
+
+// RateLimitConfig holds the rate limits of the target file.
+// Every limit that applies to a request has its own bucket,
+// the request is only allowed if none of them are empty.
+type RateLimitConfig struct {
+	//applies to every user, across all clients
+	User *RateLimit `json:"user,omitempty"`
+	//applies to every client, across all users
+	Client *RateLimit `json:"client,omitempty"`
+	//overrides Client for specific client ids
+	Clients map[string]*RateLimit `json:"clients,omitempty"`
+	//applies to every user, for the routes with this scope
+	Scopes map[string]*RateLimit `json:"scopes,omitempty"`
+}
+
+// RateLimitStore keeps the token buckets.
+// A shared store allows several instances to enforce the same limits.
+type RateLimitStore interface {
+	// Take removes a token from the bucket if there is one.
+	// It returns the number of tokens that are left.
+	Take(ctx context.Context, key string, limit *RateLimit) (allowed bool, remaining float64, err error)
+	// Refund puts back a token that was taken for a request that was rejected by another bucket.
+	Refund(ctx context.Context, key string, limit *RateLimit) error
+}
+
+// rateLimitBucket is a bucket that applies to a request.
+type rateLimitBucket struct {
+	key   string
+	limit *RateLimit
+}
+
+func NewRateLimitStore(conf *Config, svc *Service) (RateLimitStore, error) {
+	switch conf.RateLimitStore {
+	case "memory":
+		return NewMemoryRateLimitStore(), nil
+	case "postgres":
+		return NewPostgresRateLimitStore(svc.DB)
+	}
+	return nil, fmt.Errorf("unknown rate limit store: %s", conf.RateLimitStore)
+}
+
+func (limit *RateLimit) validate() error {
+	if limit.Requests <= 0 || limit.Period.Duration <= 0 {
+		return fmt.Errorf("requests and period should be positive")
+	}
+	if limit.Burst < 0 {
+		return fmt.Errorf("burst can't be negative")
+	}
+	return nil
+}
+
+func (limit *RateLimit) capacity() float64 {
+	if limit.Burst > 0 {
+		return float64(limit.Burst)
+	}
+	return float64(limit.Requests)
+}
+
+// tokens per second
+func (limit *RateLimit) rate() float64 {
+	return float64(limit.Requests) / limit.Period.Seconds()
+}
+
+func (config *RateLimitConfig) validate() error {
+	limits := map[string]*RateLimit{
+		"user":   config.User,
+		"client": config.Client,
+	}
+	for id, limit := range config.Clients {
+		limits["client "+id] = limit
+	}
+	for scope, limit := range config.Scopes {
+		limits["scope "+scope] = limit
+	}
+	for name, limit := range limits {
+		if limit == nil {
+			continue
+		}
+		err := limit.validate()
+		if err != nil {
+			return fmt.Errorf("invalid rate limit for %s: %s", name, err.Error())
+		}
+	}
+	return nil
+}
+
+// limits returns the buckets that apply to a request to a route with this scope,
+// always in the same order: user, client, scope.
+func (config *RateLimitConfig) limits(tokenInfo oauth2.TokenInfo, scope string) []rateLimitBucket {
+	result := []rateLimitBucket{}
+	if config == nil {
+		return result
+	}
+	if config.User != nil {
+		result = append(result, rateLimitBucket{"user:" + tokenInfo.GetUserID(), config.User})
+	}
+	if limit, found := config.Clients[tokenInfo.GetClientID()]; found {
+		result = append(result, rateLimitBucket{"client:" + tokenInfo.GetClientID(), limit})
+	} else if config.Client != nil {
+		result = append(result, rateLimitBucket{"client:" + tokenInfo.GetClientID(), config.Client})
+	}
+	if limit, found := config.Scopes[scope]; found {
+		result = append(result, rateLimitBucket{fmt.Sprintf("scope:%s:user:%s", scope, tokenInfo.GetUserID()), limit})
+	}
+	return result
+}
+
+// checkRateLimits takes a token from every bucket that applies and sets the RateLimit headers
+// of the most restrictive one. It returns false if the request should be rejected,
+// the tokens that were already taken from the other buckets are then put back.
+// If the store fails, the request is allowed.
+func (origin *OriginServer) checkRateLimits(w http.ResponseWriter, r *http.Request, tokenInfo oauth2.TokenInfo) bool {
+	buckets := origin.rateLimits.limits(tokenInfo, origin.Scope)
+	if len(buckets) == 0 {
+		return true
+	}
+	var strictest *RateLimit
+	strictestRemaining := math.Inf(1)
+	taken := []rateLimitBucket{}
+	for _, bucket := range buckets {
+		allowed, remaining, err := origin.svc.RateLimitStore.Take(r.Context(), bucket.key, bucket.limit)
+		if err != nil {
+			logrus.Errorf("Error checking rate limit %s: %s", bucket.key, err.Error())
+			continue
+		}
+		if !allowed {
+			origin.svc.refundRateLimits(r.Context(), taken)
+			retryAfter := (1 - remaining) / bucket.limit.rate()
+			setRateLimitHeaders(w, bucket.limit, remaining)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter))))
+			return false
+		}
+		taken = append(taken, bucket)
+		if remaining < strictestRemaining {
+			strictest, strictestRemaining = bucket.limit, remaining
+		}
+	}
+	if strictest != nil {
+		setRateLimitHeaders(w, strictest, strictestRemaining)
+	}
+	return true
+}
+
+func (svc *Service) refundRateLimits(ctx context.Context, buckets []rateLimitBucket) {
+	for _, bucket := range buckets {
+		err := svc.RateLimitStore.Refund(ctx, bucket.key, bucket.limit)
+		if err != nil {
+			logrus.Errorf("Error refunding rate limit %s: %s", bucket.key, err.Error())
+		}
+	}
+}
+
+func setRateLimitHeaders(w http.ResponseWriter, limit *RateLimit, remaining float64) {
+	reset := (limit.capacity() - remaining) / limit.rate()
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(int(limit.capacity())))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(int(math.Floor(remaining))))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(reset))))
+	w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d;burst=%d", limit.Requests, int(limit.Period.Seconds()), int(limit.capacity())))
+}
+
+type memoryBucket struct {
+	tokens    float64
+	updatedAt time.Time
+	//time after which the bucket is full again
+	fullAt time.Time
+}
+
+// MemoryRateLimitStore keeps the buckets in memory, so limits are enforced per instance.
+type MemoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*memoryBucket
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	store := &MemoryRateLimitStore{
+		buckets: map[string]*memoryBucket{},
+	}
+	go store.cleanup(time.Minute)
+	return store
+}
+
+func (store *MemoryRateLimitStore) Take(ctx context.Context, key string, limit *RateLimit) (allowed bool, remaining float64, err error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	now := time.Now()
+	bucket, found := store.buckets[key]
+	if !found {
+		bucket = &memoryBucket{tokens: limit.capacity(), updatedAt: now}
+		store.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(limit.capacity(), bucket.tokens+now.Sub(bucket.updatedAt).Seconds()*limit.rate())
+	bucket.updatedAt = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		allowed = true
+	}
+	bucket.fullAt = now.Add(time.Duration((limit.capacity() - bucket.tokens) / limit.rate() * float64(time.Second)))
+	return allowed, bucket.tokens, nil
+}
+
+func (store *MemoryRateLimitStore) Refund(ctx context.Context, key string, limit *RateLimit) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	bucket, found := store.buckets[key]
+	if !found {
+		//already removed because it was full
+		return nil
+	}
+	bucket.tokens = math.Min(limit.capacity(), bucket.tokens+1)
+	bucket.fullAt = bucket.updatedAt.Add(time.Duration((limit.capacity() - bucket.tokens) / limit.rate() * float64(time.Second)))
+	return nil
+}
+
+// cleanup removes the buckets that are full, they are the same as a new bucket.
+func (store *MemoryRateLimitStore) cleanup(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		store.mu.Lock()
+		for key, bucket := range store.buckets {
+			if now.After(bucket.fullAt) {
+				delete(store.buckets, key)
+			}
+		}
+		store.mu.Unlock()
+	}
+}
@@ -0,0 +1,78 @@
+package service
+
+import (
+	"context"
+	"oauth2server/models"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// takeTokenQuery refills the bucket for the time that passed since the last request and takes a token from it.
+// The update expressions all see the old row, so allowed and tokens are based on the same refilled amount.
+const takeTokenQuery = `
+INSERT INTO rate_limit_buckets AS b (key, tokens, allowed, updated_at)
+VALUES (@key, CAST(@capacity AS double precision) - 1, true, now())
+ON CONFLICT (key) DO UPDATE SET
+	allowed = LEAST(CAST(@capacity AS double precision), b.tokens + EXTRACT(EPOCH FROM now() - b.updated_at) * CAST(@rate AS double precision)) >= 1,
+	tokens = LEAST(CAST(@capacity AS double precision), b.tokens + EXTRACT(EPOCH FROM now() - b.updated_at) * CAST(@rate AS double precision))
+		- CASE WHEN LEAST(CAST(@capacity AS double precision), b.tokens + EXTRACT(EPOCH FROM now() - b.updated_at) * CAST(@rate AS double precision)) >= 1 THEN 1 ELSE 0 END,
+	updated_at = now()
+RETURNING allowed, tokens`
+
+// refundTokenQuery puts a token back, the refill since the last request is added by the next takeTokenQuery.
+const refundTokenQuery = `
+UPDATE rate_limit_buckets
+SET tokens = LEAST(CAST(@capacity AS double precision), tokens + 1)
+WHERE key = @key`
+
+// buckets that have not been used for this long are removed,
+// this resets limits with a longer period
+const rateLimitBucketRetention = 24 * time.Hour
+
+// PostgresRateLimitStore keeps the buckets in the database, so limits are shared by all instances.
+type PostgresRateLimitStore struct {
+	db *gorm.DB
+}
+
+func NewPostgresRateLimitStore(db *gorm.DB) (*PostgresRateLimitStore, error) {
+	err := db.AutoMigrate(&models.RateLimitBucket{})
+	if err != nil {
+		return nil, err
+	}
+	store := &PostgresRateLimitStore{db: db}
+	go store.cleanup(time.Hour)
+	return store, nil
+}
+
+func (store *PostgresRateLimitStore) Take(ctx context.Context, key string, limit *RateLimit) (allowed bool, remaining float64, err error) {
+	result := &models.RateLimitBucket{}
+	err = store.db.WithContext(ctx).Raw(takeTokenQuery, map[string]interface{}{
+		"key":      key,
+		"capacity": limit.capacity(),
+		"rate":     limit.rate(),
+	}).Scan(result).Error
+	if err != nil {
+		return false, 0, err
+	}
+	return result.Allowed, result.Tokens, nil
+}
+
+func (store *PostgresRateLimitStore) Refund(ctx context.Context, key string, limit *RateLimit) error {
+	return store.db.WithContext(ctx).Exec(refundTokenQuery, map[string]interface{}{
+		"key":      key,
+		"capacity": limit.capacity(),
+	}).Error
+}
+
+func (store *PostgresRateLimitStore) cleanup(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		err := store.db.Where("updated_at < ?", time.Now().Add(-rateLimitBucketRetention)).Delete(&models.RateLimitBucket{}).Error
+		if err != nil {
+			logrus.Errorf("Error removing old rate limit buckets: %s", err.Error())
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const wildcardScopeSuffix = "*"
+
+// isWildcardScope returns true for scopes like invoices:*, that grant all scopes starting with invoices:
+func isWildcardScope(scope string) bool {
+	return strings.HasSuffix(scope, ":"+wildcardScopeSuffix)
+}
+
+// closeImplications validates the scope implications of the target file
+// and adds the scopes that are implied indirectly, so invoices:create => invoices:read => balance:read
+// results in invoices:create implying both.
+func closeImplications(implications map[string][]string, scopes map[string]string) (map[string][]string, error) {
+	for scope, implied := range implications {
+		if _, found := scopes[scope]; !found {
+			return nil, fmt.Errorf("scopeImplications: %s is not the scope of any target", scope)
+		}
+		for _, sc := range implied {
+			if _, found := scopes[sc]; !found {
+				return nil, fmt.Errorf("scopeImplications: %s implies %s, which is not the scope of any target", scope, sc)
+			}
+		}
+	}
+	result := map[string][]string{}
+	for scope := range implications {
+		visited := map[string]bool{scope: true}
+		queue := []string{scope}
+		for len(queue) > 0 {
+			current := queue[0]
+			queue = queue[1:]
+			for _, implied := range implications[current] {
+				if !visited[implied] {
+					visited[implied] = true
+					queue = append(queue, implied)
+				}
+			}
+		}
+		delete(visited, scope)
+		for implied := range visited {
+			result[scope] = append(result[scope], implied)
+		}
+		sort.Strings(result[scope])
+	}
+	return result, nil
+}
+
+// ExpandScopes returns the scopes that a space separated list of granted scopes gives access to,
+// with their descriptions: the scopes themselves, the scopes they imply, and the scopes matching a wildcard.
+// Wildcards match the scopes of the current targets, so they also grant scopes that are added later.
+func (svc *Service) ExpandScopes(granted string) map[string]string {
+	result := map[string]string{}
+	state := svc.currentGateway()
+	if state == nil {
+		return result
+	}
+	add := func(scope string) {
+		result[scope] = state.scopes[scope]
+		for _, implied := range state.implications[scope] {
+			result[implied] = state.scopes[implied]
+		}
+	}
+	for _, scope := range strings.Split(granted, " ") {
+		if isWildcardScope(scope) {
+			prefix := strings.TrimSuffix(scope, wildcardScopeSuffix)
+			for sc := range state.scopes {
+				if strings.HasPrefix(sc, prefix) {
+					add(sc)
+				}
+			}
+			continue
+		}
+		//scopes of targets that were removed give no access
+		if _, found := state.scopes[scope]; found {
+			add(scope)
+		}
+	}
+	return result
+}
+
+// ScopeAllowed returns true if the space separated granted scopes give access to the scope.
+func (svc *Service) ScopeAllowed(granted, scope string) bool {
+	_, found := svc.ExpandScopes(granted)[scope]
+	return found
+}
+
+// ValidateRequestedScope checks the scope that a client asks a user to grant.
+// Only trusted clients can ask for wildcard scopes.
+func (svc *Service) ValidateRequestedScope(ctx context.Context, clientId, requested string) error {
+	if requested == "" {
+		return fmt.Errorf("Empty scope is not allowed")
+	}
+	scopes := svc.Scopes()
+	for _, scope := range strings.Split(requested, " ") {
+		if !isWildcardScope(scope) {
+			if _, found := scopes[scope]; !found {
+				return fmt.Errorf("Scope not allowed: %s", scope)
+			}
+			continue
+		}
+		md, err := svc.ClientMetaData(ctx, clientId)
+		if err != nil {
+			return err
+		}
+		if md == nil || !md.Trusted {
+			return fmt.Errorf("Wildcard scope %s is only allowed for trusted clients", scope)
+		}
+		if len(svc.ExpandScopes(scope)) == 0 {
+			return fmt.Errorf("Scope not allowed: %s", scope)
+		}
+	}
+	return nil
+}
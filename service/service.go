@@ -2,15 +2,15 @@ package service
 
 import (
 	"database/sql"
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"net"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 	"oauth2server/constants"
 	"oauth2server/models"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	oauth2gorm "github.com/getAlby/go-oauth2-gorm"
@@ -30,11 +30,30 @@ import (
 
 type Service struct {
 	OauthServer *server.Server
-	Endpoints   []*OriginServer
 	Config      *Config
 	ClientStore *oauth2gorm.ClientStore
 	DB          *gorm.DB
-	Scopes      map[string]string
+	//keeps the token buckets of the gateway rate limits
+	RateLimitStore RateLimitStore
+	//cache for the targets that have caching enabled
+	ResponseCache *ResponseCache
+	//caches access token lookups, nil if disabled
+	tokenStore *cachedTokenStore
+	//LNDhub JWTs that are reused for the requests of a user
+	mintedTokens mintedTokenCache
+	//short lived cache of the client metadata used by the gateway
+	clientCache      map[string]*clientCacheEntry
+	clientCacheMutex sync.Mutex
+	//browser origins of the client domains, for CORS
+	corsOrigins *corsOrigins
+	corsMutex   sync.Mutex
+	//proxies whose X-Forwarded-For, CF-Connecting-IP and CF-IPCountry headers are used
+	trustedProxies []*net.IPNet
+	//wakes up the webhook delivery worker when events are queued
+	webhookWake chan struct{}
+	//holds the *gatewayState that is currently being served
+	gateway      atomic.Value
+	gatewayMutex sync.Mutex
 }
 
 func CombinedClientInfoHandler(r *http.Request) (clientID, clientSecret string, err error) {
@@ -58,6 +77,10 @@ func (svc *Service) AccessTokenExpHandler(w http.ResponseWriter, r *http.Request
 }
 
 func InitService(conf *Config) (svc *Service, err error) {
+	trustedProxies, err := ParseTrustedProxies(conf.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TRUSTED_PROXIES: %s", err.Error())
+	}
 	manager := manage.NewDefaultManager()
 	manager.SetAuthorizeCodeTokenCfg(manage.DefaultAuthorizeCodeTokenCfg)
 
@@ -66,7 +89,18 @@ func InitService(conf *Config) (svc *Service, err error) {
 		logrus.Fatalf("Error connecting db: %s", err.Error())
 	}
 	manager.MapClientStorage(clientStore)
-	manager.MapTokenStorage(tokenStore)
+	var cachedStore *cachedTokenStore
+	if conf.TokenCacheSize > 0 {
+		cachedStore = &cachedTokenStore{
+			TokenStore: tokenStore,
+			cache:      NewTokenCache(conf.TokenCacheSize, time.Duration(conf.TokenCacheSeconds)*time.Second),
+			db:         db,
+		}
+		go cachedStore.cache.listen(conf.DatabaseUri)
+		manager.MapTokenStorage(cachedStore)
+	} else {
+		manager.MapTokenStorage(tokenStore)
+	}
 
 	manager.SetValidateURIHandler(CheckRedirectUriDomain)
 
@@ -89,12 +123,21 @@ func InitService(conf *Config) (svc *Service, err error) {
 	srv := server.NewServer(server.NewConfig(), manager)
 	srv.ClientInfoHandler = CombinedClientInfoHandler
 	svc = &Service{
-		DB:          db,
-		OauthServer: srv,
-		Config:      conf,
-		ClientStore: clientStore,
-	}
+		DB:             db,
+		OauthServer:    srv,
+		Config:         conf,
+		ClientStore:    clientStore,
+		tokenStore:     cachedStore,
+		trustedProxies: trustedProxies,
+		webhookWake:    make(chan struct{}, 1),
+	}
+	svc.ResponseCache = NewResponseCache(conf.ResponseCacheMaxBytes)
 	srv.AccessTokenExpHandler = svc.AccessTokenExpHandler
+	svc.RateLimitStore, err = NewRateLimitStore(conf, svc)
+	if err != nil {
+		return nil, err
+	}
+	go svc.cleanupIdempotencyKeys(time.Hour)
 	return svc, nil
 }
 
@@ -140,7 +183,7 @@ func initStores(dsn string, cfg *Config) (clientStore *oauth2gorm.ClientStore, t
 	clientStore = oauth2gorm.NewClientStoreWithDB(&oauth2gorm.Config{TableName: constants.ClientTableName}, db)
 
 	//initialize extra db tables
-	err = db.AutoMigrate(&models.ClientMetaData{})
+	err = db.AutoMigrate(&models.ClientMetaData{}, &models.ClientUsage{}, &models.StreamTicket{}, &models.IdempotencyKey{}, &models.WebhookEndpoint{}, &models.WebhookDelivery{})
 	if err != nil {
 		return nil, nil, nil, err
 	}
@@ -149,52 +192,22 @@ func initStores(dsn string, cfg *Config) (clientStore *oauth2gorm.ClientStore, t
 	return
 }
 
-func (svc *Service) InitGateways() (result []*OriginServer, err error) {
-	targetBytes, err := ioutil.ReadFile(svc.Config.TargetFile)
-	if err != nil {
-		return nil, err
-	}
-	result = []*OriginServer{}
-	err = json.Unmarshal(targetBytes, &result)
-	if err != nil {
-		return nil, err
-	}
-	svc.Endpoints = result
-	svc.Scopes = map[string]string{}
-	originHelperMap := map[string]http.Handler{}
-	for _, origin := range result {
-		origin.svc = svc
-		svc.Scopes[origin.Scope] = origin.Description
-		//avoid creating too much identical origin server objects
-		//by storing them in a map
-		value, found := originHelperMap[origin.Origin]
-		if found {
-			//use existing one
-			origin.proxy = value
-		} else {
-			//create new one
-			originUrl, err := url.Parse(origin.Origin)
-			if err != nil {
-				return nil, err
-			}
-			proxy := httputil.NewSingleHostReverseProxy(originUrl)
-			originHelperMap[origin.Origin] = proxy
-			origin.proxy = proxy
-		}
-	}
-	return result, nil
-}
-
 func (svc *Service) InjectJWTAccessToken(token oauth2.TokenInfo, r *http.Request) error {
 	//mint and inject jwt token needed for origin server
 	//the request is dispatched immediately, so the tokens can have a short expiry
-	expirySeconds := 60
+	//and a token is reused for the requests of the same user until shortly before it expires
 	lndhubId := token.GetUserID()
-	lndhubToken, err := GenerateLNDHubAccessToken(svc.Config.JWTSecret, expirySeconds, lndhubId)
-	if err != nil {
-		return err
+	lndhubToken := svc.mintedTokens.get(lndhubId)
+	if lndhubToken == "" {
+		expires := time.Now().Add(mintedTokenExpirySeconds * time.Second)
+		var err error
+		lndhubToken, err = GenerateLNDHubAccessToken(svc.Config.JWTSecret, mintedTokenExpirySeconds, lndhubId)
+		if err != nil {
+			return err
+		}
+		svc.mintedTokens.set(lndhubId, lndhubToken, expires)
 	}
-	r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", lndhubToken))
+	r.Header.Set("Authorization", "Bearer "+lndhubToken)
 	return nil
 }
 
@@ -0,0 +1,182 @@
+package service
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/felixge/httpsnoop"
+	"github.com/go-oauth2/oauth2/v4"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	//shadow requests that can be in flight per target, requests are not mirrored when they are all used
+	maxShadowRequests = 100
+	shadowTimeout     = time.Minute
+)
+
+var (
+	shadowRequests         = expvar.NewInt("shadow_requests")
+	shadowStatusMismatches = expvar.NewInt("shadow_status_mismatches")
+	shadowSkipped          = expvar.NewInt("shadow_skipped")
+)
+
+func (origin *OriginServer) validateShadow() error {
+	if origin.ShadowOrigin == "" {
+		if origin.ShadowSampleRate != nil {
+			return fmt.Errorf("shadowSampleRate needs a shadowOrigin")
+		}
+		return nil
+	}
+	parsed, err := url.Parse(origin.ShadowOrigin)
+	if err != nil {
+		return err
+	}
+	if parsed.Scheme == "" || parsed.Host == "" {
+		return fmt.Errorf("shadowOrigin should be an absolute url")
+	}
+	if rate := origin.ShadowSampleRate; rate != nil && (*rate < 0 || *rate > 1) {
+		return fmt.Errorf("shadowSampleRate should be between 0 and 1")
+	}
+	return nil
+}
+
+// shadowMirror sends a copy of a request to the shadow origin,
+// and compares its response with the response of the origin once both are done.
+type shadowMirror struct {
+	origin  *OriginServer
+	req     *http.Request
+	start   time.Time
+	status  int
+	primary chan shadowResult
+}
+
+type shadowResult struct {
+	status  int
+	latency time.Duration
+}
+
+// startShadow starts mirroring the request if the target has a shadow origin and the request is sampled.
+// Only GET and HEAD requests without a body are mirrored, sending other requests twice could have side effects.
+// The request is sent with its own credentials, minted the same way as for the origin.
+func (origin *OriginServer) startShadow(r *http.Request, tokenInfo oauth2.TokenInfo) *shadowMirror {
+	if origin.shadow == nil || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return nil
+	}
+	if r.ContentLength != 0 || (r.Body != nil && r.Body != http.NoBody) {
+		return nil
+	}
+	if rate := origin.ShadowSampleRate; rate != nil && rand.Float64() >= *rate {
+		return nil
+	}
+	select {
+	case origin.shadowSlots <- struct{}{}:
+	default:
+		shadowSkipped.Add(1)
+		return nil
+	}
+	//the shadow request finishes on its own, also when the client goes away
+	ctx, cancel := context.WithTimeout(detachedContext{r.Context()}, shadowTimeout)
+	req := r.Clone(ctx)
+	err := origin.shadowCredentials.Inject(req, tokenInfo)
+	if err != nil {
+		cancel()
+		<-origin.shadowSlots
+		logrus.Errorf("Something went wrong injecting credentials for the shadow of %s: %s", origin.MatchRoute, err.Error())
+		return nil
+	}
+	mirror := &shadowMirror{
+		origin:  origin,
+		req:     req,
+		start:   time.Now(),
+		primary: make(chan shadowResult, 1),
+	}
+	go func() {
+		defer cancel()
+		mirror.run()
+	}()
+	return mirror
+}
+
+// wrap records the status of the response of the origin.
+func (mirror *shadowMirror) wrap(w http.ResponseWriter) http.ResponseWriter {
+	return httpsnoop.Wrap(w, httpsnoop.Hooks{
+		WriteHeader: func(next httpsnoop.WriteHeaderFunc) httpsnoop.WriteHeaderFunc {
+			return func(code int) {
+				if mirror.status == 0 {
+					mirror.status = code
+				}
+				next(code)
+			}
+		},
+		Write: func(next httpsnoop.WriteFunc) httpsnoop.WriteFunc {
+			return func(b []byte) (int, error) {
+				if mirror.status == 0 {
+					mirror.status = http.StatusOK
+				}
+				return next(b)
+			}
+		},
+	})
+}
+
+// finish is called when the response of the origin is written.
+func (mirror *shadowMirror) finish() {
+	mirror.primary <- shadowResult{status: mirror.status, latency: time.Since(mirror.start)}
+}
+
+func (mirror *shadowMirror) run() {
+	defer func() { <-mirror.origin.shadowSlots }()
+	//the response is discarded
+	rec := &shadowResponseWriter{header: http.Header{}}
+	mirror.origin.shadow.proxy.ServeHTTP(rec, mirror.req)
+	shadow := shadowResult{status: rec.status, latency: time.Since(mirror.start)}
+	primary := <-mirror.primary
+
+	shadowRequests.Add(1)
+	entry := logrus.WithFields(logrus.Fields{
+		"route":          mirror.origin.MatchRoute,
+		"shadow_origin":  mirror.origin.ShadowOrigin,
+		"method":         mirror.req.Method,
+		"uri":            mirror.req.URL.Path,
+		"status":         primary.status,
+		"shadow_status":  shadow.status,
+		"latency":        primary.latency.Seconds(),
+		"shadow_latency": shadow.latency.Seconds(),
+		"latency_diff":   (shadow.latency - primary.latency).Seconds(),
+	})
+	if primary.status != shadow.status {
+		shadowStatusMismatches.Add(1)
+		entry.Warn("shadow status mismatch")
+		return
+	}
+	entry.Info("shadow request")
+}
+
+// shadowResponseWriter discards the response of the shadow origin, it only keeps the status.
+type shadowResponseWriter struct {
+	header http.Header
+	status int
+}
+
+func (rec *shadowResponseWriter) Header() http.Header {
+	return rec.header
+}
+
+func (rec *shadowResponseWriter) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+}
+
+func (rec *shadowResponseWriter) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return len(b), nil
+}
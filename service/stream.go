@@ -0,0 +1,217 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"oauth2server/constants"
+	"oauth2server/models"
+	"strings"
+	"time"
+
+	oauth2gorm "github.com/getAlby/go-oauth2-gorm"
+	"github.com/go-oauth2/oauth2/v4"
+	"github.com/labstack/gommon/random"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	StreamWebSocket = "websocket"
+	StreamSSE       = "sse"
+
+	//websocket clients can send their access token as the subprotocol bearer.<access token>
+	bearerSubprotocolPrefix = "bearer."
+	//clients that can't set headers can pass a ticket as query parameter
+	streamTicketParam = "ticket"
+
+	defaultStreamRevalidateInterval = 30 * time.Second
+)
+
+// streamType returns the kind of long lived connection the request asks for, if any.
+// Both are opened with a GET request.
+func streamType(r *http.Request) string {
+	if r.Method != http.MethodGet {
+		return ""
+	}
+	if headerContains(r.Header, "Connection", "upgrade") && strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return StreamWebSocket
+	}
+	if headerContains(r.Header, "Accept", "text/event-stream") {
+		return StreamSSE
+	}
+	return ""
+}
+
+func headerContains(header http.Header, key, value string) bool {
+	for _, v := range header.Values(key) {
+		for _, part := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(strings.SplitN(part, ";", 2)[0]), value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type bearerSubprotocolKey struct{}
+
+// streamAccessToken finds the access token of a stream request without an Authorization header.
+// The token or ticket is removed from the request, so it is not sent to the origin.
+// When the token is a subprotocol, the returned request remembers it, so it can be selected in the response.
+func (svc *Service) streamAccessToken(r *http.Request) (token string, result *http.Request, err error) {
+	//subprotocol, for websockets
+	protocols := []string{}
+	bearerProtocol := ""
+	for _, v := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, protocol := range strings.Split(v, ",") {
+			protocol = strings.TrimSpace(protocol)
+			if strings.HasPrefix(protocol, bearerSubprotocolPrefix) {
+				bearerProtocol = protocol
+				token = strings.TrimPrefix(protocol, bearerSubprotocolPrefix)
+				continue
+			}
+			protocols = append(protocols, protocol)
+		}
+	}
+	if token != "" {
+		r.Header.Del("Sec-WebSocket-Protocol")
+		if len(protocols) > 0 {
+			r.Header.Set("Sec-WebSocket-Protocol", strings.Join(protocols, ", "))
+		}
+		return token, r.WithContext(context.WithValue(r.Context(), bearerSubprotocolKey{}, bearerProtocol)), nil
+	}
+	//one time ticket
+	query := r.URL.Query()
+	ticket := query.Get(streamTicketParam)
+	if ticket == "" {
+		return "", r, nil
+	}
+	query.Del(streamTicketParam)
+	r.URL.RawQuery = query.Encode()
+	token, err = svc.redeemStreamTicket(r.Context(), ticket)
+	return token, r, err
+}
+
+// selectBearerSubprotocol selects the bearer subprotocol in the handshake response when the origin selected none.
+// Browsers fail the handshake if they offered subprotocols and none is selected.
+func selectBearerSubprotocol(resp *http.Response) {
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Protocol") != "" {
+		return
+	}
+	if protocol, ok := resp.Request.Context().Value(bearerSubprotocolKey{}).(string); ok {
+		resp.Header.Set("Sec-WebSocket-Protocol", protocol)
+	}
+}
+
+// CreateStreamTicket returns a short lived ticket that can be used once instead of the access token
+// to open a websocket or event stream.
+func (svc *Service) CreateStreamTicket(ctx context.Context, tokenInfo oauth2.TokenInfo) (ticket string, err error) {
+	//the ticket refers to the stored token, so the access token itself is not stored again
+	item := &oauth2gorm.TokenStoreItem{}
+	err = svc.DB.WithContext(ctx).Table(constants.TokenTableName).Where("access = ?", tokenInfo.GetAccess()).First(item).Error
+	if err != nil {
+		return "", err
+	}
+	ticket = random.New().String(32, random.Alphanumeric)
+	err = svc.DB.WithContext(ctx).Create(&models.StreamTicket{
+		TicketHash: hashTicket(ticket),
+		TokenID:    item.ID,
+		ExpiresAt:  time.Now().Add(constants.StreamTicketSeconds * time.Second),
+	}).Error
+	if err != nil {
+		return "", err
+	}
+	return ticket, nil
+}
+
+func (svc *Service) redeemStreamTicket(ctx context.Context, ticket string) (token string, err error) {
+	redeemed := []models.StreamTicket{}
+	//deleting makes sure the ticket is only used once, even with multiple instances
+	err = svc.DB.WithContext(ctx).Clauses(clause.Returning{}).
+		Where("ticket_hash = ?", hashTicket(ticket)).
+		Delete(&redeemed).Error
+	if err != nil {
+		return "", err
+	}
+	if len(redeemed) == 0 || time.Now().After(redeemed[0].ExpiresAt) {
+		return "", fmt.Errorf("invalid or expired ticket")
+	}
+	//clean up tickets that were never used
+	err = svc.DB.WithContext(ctx).Where("expires_at < ?", time.Now()).Delete(&models.StreamTicket{}).Error
+	if err != nil {
+		logrus.Errorf("Error removing expired stream tickets: %s", err.Error())
+	}
+	item := &oauth2gorm.TokenStoreItem{}
+	err = svc.DB.WithContext(ctx).Table(constants.TokenTableName).Where("id = ?", redeemed[0].TokenID).First(item).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", fmt.Errorf("invalid or expired ticket")
+	}
+	if err != nil {
+		return "", err
+	}
+	return item.Access, nil
+}
+
+func hashTicket(ticket string) string {
+	hash := sha256.Sum256([]byte(ticket))
+	return hex.EncodeToString(hash[:])
+}
+
+// watchStream closes the stream by cancelling its context once the access token expires,
+// or when it is no longer found (because it was revoked) when it is checked every StreamRevalidateSeconds.
+// It returns the reason the stream was closed, or an empty string when the context was cancelled otherwise.
+func (svc *Service) watchStream(ctx context.Context, cancel context.CancelFunc, tokenInfo oauth2.TokenInfo) (reason string) {
+	var expired <-chan time.Time
+	if expiresIn := tokenInfo.GetAccessExpiresIn(); expiresIn > 0 {
+		timer := time.NewTimer(time.Until(tokenInfo.GetAccessCreateAt().Add(expiresIn)))
+		defer timer.Stop()
+		expired = timer.C
+	}
+	interval := time.Duration(svc.Config.StreamRevalidateSeconds) * time.Second
+	if interval <= 0 {
+		interval = defaultStreamRevalidateInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ""
+		case <-expired:
+			cancel()
+			return "token_expired"
+		case <-ticker.C:
+			_, err := svc.OauthServer.Manager.LoadAccessToken(ctx, tokenInfo.GetAccess())
+			if err == nil || ctx.Err() != nil {
+				continue
+			}
+			if _, found := errorResponses[err.Error()]; found {
+				cancel()
+				return "token_revoked"
+			}
+			//keep the stream open if the check itself fails
+			logrus.Errorf("Error revalidating access token of stream: %s", err.Error())
+		}
+	}
+}
+
+// proxyStream proxies a websocket or event stream, and closes it when the access token is no longer valid.
+func (origin *OriginServer) proxyStream(w http.ResponseWriter, r *http.Request, tokenInfo oauth2.TokenInfo, logTokenInfo *models.LogTokenInfo) {
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	closed := make(chan string, 1)
+	go func() {
+		closed <- origin.svc.watchStream(ctx, cancel, tokenInfo)
+	}()
+	origin.proxy.ServeHTTP(w, r.WithContext(ctx))
+	cancel()
+	reason := <-closed
+	if logTokenInfo != nil {
+		logTokenInfo.StreamClosedBy = reason
+	}
+}
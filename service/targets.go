@@ -0,0 +1,461 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+var rewriteVarRegexp = regexp.MustCompile(`\{([^{}]+)\}`)
+
+// gatewayState is everything that is derived from the target file.
+// It is never modified after it has been built, a reload swaps it as a whole.
+type gatewayState struct {
+	endpoints []*OriginServer
+	scopes    map[string]string
+	upstreams map[string]*upstream
+	//load balanced origins, by strategy and origin urls
+	pools  map[string]*pool
+	router *mux.Router
+	//scope a user has to grant for each webhook event type
+	webhookEvents map[string]string
+	//all scopes implied by a scope, directly or indirectly
+	implications map[string][]string
+	//scopes of the targets served on each host that has targets of its own
+	hostScopes map[string]map[string]string
+}
+
+func (svc *Service) InitGateways() (result []*OriginServer, err error) {
+	svc.gatewayMutex.Lock()
+	defer svc.gatewayMutex.Unlock()
+	state, err := svc.loadGateway()
+	if err != nil {
+		return nil, err
+	}
+	state.start()
+	svc.gateway.Store(state)
+	return state.endpoints, nil
+}
+
+// ReloadGateways re-reads the target file and swaps the gateway config.
+// If the new config is invalid, the current one is kept.
+// Requests that are in flight keep using the config they were routed with.
+func (svc *Service) ReloadGateways() (result []*OriginServer, err error) {
+	svc.gatewayMutex.Lock()
+	defer svc.gatewayMutex.Unlock()
+	state, err := svc.loadGateway()
+	if err != nil {
+		logrus.Errorf("Error reloading gateway targets from %s, keeping current config: %s", svc.Config.TargetFile, err.Error())
+		return nil, err
+	}
+	previous := svc.currentGateway()
+	state.start()
+	svc.gateway.Store(state)
+	if previous != nil {
+		previous.close()
+	}
+	logrus.Infof("Reloaded %d gateway targets from %s", len(state.endpoints), svc.Config.TargetFile)
+	return state.endpoints, nil
+}
+
+// GatewayHandler routes requests to the targets of the current gateway config.
+func (svc *Service) GatewayHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state := svc.currentGateway()
+		if state == nil {
+			http.NotFound(w, r)
+			return
+		}
+		//host names are case insensitive, the host routes are lowercase
+		r.Host = strings.ToLower(r.Host)
+		state.router.ServeHTTP(w, r)
+	})
+}
+
+func (svc *Service) Endpoints() []*OriginServer {
+	state := svc.currentGateway()
+	if state == nil {
+		return nil
+	}
+	return state.endpoints
+}
+
+func (svc *Service) Scopes() map[string]string {
+	state := svc.currentGateway()
+	if state == nil {
+		return map[string]string{}
+	}
+	return state.scopes
+}
+
+// UpstreamHealth returns the circuit breaker state of every origin.
+func (svc *Service) UpstreamHealth() map[string]UpstreamHealth {
+	result := map[string]UpstreamHealth{}
+	state := svc.currentGateway()
+	if state == nil {
+		return result
+	}
+	for origin, up := range state.upstreams {
+		result[origin] = up.health()
+	}
+	//instances without a circuit breaker of their own show the one of their pool, the open one if there are several
+	for _, p := range state.pools {
+		for origin, ejection := range p.health() {
+			health := result[origin]
+			if health.CircuitBreaker == "disabled" || ejection.CircuitBreaker != breakerClosed {
+				health.CircuitBreaker, health.Failures = ejection.CircuitBreaker, ejection.Failures
+			}
+			result[origin] = health
+		}
+	}
+	return result
+}
+
+func (state *gatewayState) start() {
+	for _, up := range state.upstreams {
+		up.start()
+	}
+}
+
+func (state *gatewayState) close() {
+	for _, up := range state.upstreams {
+		up.close()
+	}
+}
+
+func (svc *Service) currentGateway() *gatewayState {
+	state, _ := svc.gateway.Load().(*gatewayState)
+	return state
+}
+
+// ReloadGatewaysOnSignal blocks and reloads the gateway targets on every SIGHUP.
+func (svc *Service) ReloadGatewaysOnSignal() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	for range sigs {
+		logrus.Info("Received SIGHUP, reloading gateway targets")
+		//errors are already logged
+		_, _ = svc.ReloadGateways()
+	}
+}
+
+// WatchTargetFile blocks and reloads the gateway targets
+// whenever the modification time or the size of the target file changes.
+func (svc *Service) WatchTargetFile(interval time.Duration) {
+	lastModified, lastSize := time.Time{}, int64(-1)
+	if info, err := os.Stat(svc.Config.TargetFile); err == nil {
+		lastModified, lastSize = info.ModTime(), info.Size()
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		info, err := os.Stat(svc.Config.TargetFile)
+		if err != nil {
+			logrus.Errorf("Error watching target file %s: %s", svc.Config.TargetFile, err.Error())
+			continue
+		}
+		if info.ModTime().Equal(lastModified) && info.Size() == lastSize {
+			continue
+		}
+		lastModified, lastSize = info.ModTime(), info.Size()
+		logrus.Infof("Target file %s changed, reloading gateway targets", svc.Config.TargetFile)
+		_, _ = svc.ReloadGateways()
+	}
+}
+
+func (svc *Service) loadGateway() (state *gatewayState, err error) {
+	targets, err := readTargets(svc.Config.TargetFile)
+	if err != nil {
+		return nil, err
+	}
+	state = &gatewayState{
+		endpoints:     targets.Targets,
+		scopes:        map[string]string{},
+		upstreams:     map[string]*upstream{},
+		pools:         map[string]*pool{},
+		router:        mux.NewRouter(),
+		webhookEvents: targets.WebhookEvents,
+		implications:  targets.implications,
+		hostScopes:    hostScopes(targets.Targets),
+	}
+	for _, origin := range routeOrder(targets.Targets) {
+		origin.svc = svc
+		origin.rateLimits = targets.RateLimits
+		state.scopes[origin.Scope] = origin.Description
+		//avoid creating too much identical origin server objects
+		//by storing them in a map
+		instances := []*upstream{}
+		for _, originUrl := range origin.originURLs() {
+			up, found := state.upstreams[originUrl]
+			if !found {
+				up, err = newUpstream(originUrl, targets.Upstreams[originUrl])
+				if err != nil {
+					return nil, err
+				}
+				state.upstreams[originUrl] = up
+			}
+			instances = append(instances, up)
+		}
+		if len(origin.Origins) == 0 {
+			origin.proxy = instances[0].proxy
+		} else {
+			key := poolKey(origin.Origins, origin.LoadBalancing)
+			p, found := state.pools[key]
+			if !found {
+				p, err = newPool(instances, origin.LoadBalancing)
+				if err != nil {
+					return nil, err
+				}
+				state.pools[key] = p
+			}
+			origin.proxy = p.proxy
+		}
+		origin.credentials, err = svc.newCredentialInjector(origin.Credentials, origin.originURLs()[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid credentials for target %s: %s", origin.MatchRoute, err.Error())
+		}
+		if origin.ShadowOrigin != "" {
+			up, found := state.upstreams[origin.ShadowOrigin]
+			if !found {
+				up, err = newUpstream(origin.ShadowOrigin, targets.Upstreams[origin.ShadowOrigin])
+				if err != nil {
+					return nil, err
+				}
+				state.upstreams[origin.ShadowOrigin] = up
+			}
+			origin.shadow = up
+			origin.shadowSlots = make(chan struct{}, maxShadowRequests)
+			origin.shadowCredentials, err = svc.newCredentialInjector(origin.Credentials, origin.ShadowOrigin)
+			if err != nil {
+				return nil, fmt.Errorf("invalid credentials for target %s: %s", origin.MatchRoute, err.Error())
+			}
+		}
+		err = origin.registerRoute(state.router)
+		if err != nil {
+			return nil, fmt.Errorf("invalid target %s: %s", origin.MatchRoute, err.Error())
+		}
+	}
+	return state, nil
+}
+
+// routeOrder returns the endpoints in the order they should be registered in:
+// routes of a host before the routes of all hosts, then exact routes,
+// then prefix routes with the longest prefix first, so that a prefix never hides a more specific route.
+func routeOrder(endpoints []*OriginServer) []*OriginServer {
+	result := make([]*OriginServer, len(endpoints))
+	copy(result, endpoints)
+	sort.SliceStable(result, func(i, j int) bool {
+		if (result[i].Host == "") != (result[j].Host == "") {
+			return result[i].Host != ""
+		}
+		if result[i].PathPrefix != result[j].PathPrefix {
+			return !result[i].PathPrefix
+		}
+		return result[i].PathPrefix && len(result[i].MatchRoute) > len(result[j].MatchRoute)
+	})
+	return result
+}
+
+func (origin *OriginServer) registerRoute(router *mux.Router) error {
+	route := router.NewRoute()
+	if origin.Host != "" {
+		route = route.Host(origin.Host)
+	}
+	if origin.PathPrefix {
+		route = route.PathPrefix(origin.MatchRoute)
+	} else {
+		route = route.Path(origin.MatchRoute)
+	}
+	if len(origin.Methods) > 0 {
+		route = route.Methods(origin.Methods...)
+	}
+	route = route.Handler(origin)
+	if route.GetError() != nil {
+		return route.GetError()
+	}
+	pathRegexp, err := route.GetPathRegexp()
+	if err != nil {
+		return err
+	}
+	origin.pathRegexp, err = regexp.Compile(pathRegexp)
+	if err != nil {
+		return err
+	}
+	//all variables used in the rewrite should be matched
+	varNames := map[string]bool{}
+	for _, match := range rewriteVarRegexp.FindAllStringSubmatch(origin.MatchRoute, -1) {
+		//strip the pattern from {name:pattern}
+		varNames[strings.SplitN(match[1], ":", 2)[0]] = true
+	}
+	for _, match := range rewriteVarRegexp.FindAllStringSubmatch(origin.Rewrite, -1) {
+		if !varNames[match[1]] {
+			return fmt.Errorf("rewrite uses variable %s which is not in matchRoute", match[0])
+		}
+	}
+	return nil
+}
+
+// TargetFile is the content of the target file.
+// The file can also contain only the array of targets.
+type TargetFile struct {
+	//settings per origin url
+	Upstreams  map[string]*UpstreamConfig `json:"upstreams,omitempty"`
+	Targets    []*OriginServer            `json:"targets"`
+	RateLimits *RateLimitConfig           `json:"rateLimits,omitempty"`
+	//webhook event types and the scope they need, eg. "invoice.settled": "invoices:read"
+	WebhookEvents map[string]string `json:"webhookEvents,omitempty"`
+	//scopes that are granted along with a scope, eg. "invoices:create": ["invoices:read"]
+	ScopeImplications map[string][]string `json:"scopeImplications,omitempty"`
+	implications      map[string][]string
+}
+
+func readTargets(file string) (result *TargetFile, err error) {
+	targetBytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	result = &TargetFile{}
+	if strings.HasPrefix(strings.TrimSpace(string(targetBytes)), "[") {
+		err = json.Unmarshal(targetBytes, &result.Targets)
+	} else {
+		err = json.Unmarshal(targetBytes, result)
+	}
+	if err != nil {
+		return nil, err
+	}
+	origins := map[string]bool{}
+	scopes := map[string]string{}
+	for i, origin := range result.Targets {
+		err = origin.validate()
+		if err != nil {
+			return nil, fmt.Errorf("invalid target %d (%s): %s", i, origin.MatchRoute, err.Error())
+		}
+		for _, originUrl := range origin.originURLs() {
+			origins[originUrl] = true
+		}
+		if origin.ShadowOrigin != "" {
+			origins[origin.ShadowOrigin] = true
+		}
+		scopes[origin.Scope] = origin.Description
+	}
+	err = validateWebhookEvents(result.WebhookEvents, scopes)
+	if err != nil {
+		return nil, err
+	}
+	result.implications, err = closeImplications(result.ScopeImplications, scopes)
+	if err != nil {
+		return nil, err
+	}
+	for origin, config := range result.Upstreams {
+		if !origins[origin] {
+			return nil, fmt.Errorf("upstream %s is not the origin of any target", origin)
+		}
+		err = config.validate()
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream %s: %s", origin, err.Error())
+		}
+	}
+	if result.RateLimits != nil {
+		err = result.RateLimits.validate()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func (origin *OriginServer) validate() error {
+	if !strings.HasPrefix(origin.MatchRoute, "/") {
+		return fmt.Errorf("matchRoute should start with /")
+	}
+	if origin.Rewrite != "" && origin.StripPrefix != "" {
+		return fmt.Errorf("only one of rewrite and stripPrefix can be used")
+	}
+	if origin.Rewrite != "" && !strings.HasPrefix(origin.Rewrite, "/") {
+		return fmt.Errorf("rewrite should start with /")
+	}
+	if origin.Scope == "" {
+		return fmt.Errorf("scope is required")
+	}
+	if origin.Cache != nil {
+		err := origin.Cache.validate()
+		if err != nil {
+			return err
+		}
+	}
+	if origin.Streams && len(origin.ResponseFields) > 0 {
+		//streamed responses can't be filtered
+		return fmt.Errorf("responseFields can't be used with streams")
+	}
+	for scope, filter := range origin.ResponseFields {
+		if filter == nil {
+			return fmt.Errorf("invalid responseFields for %s: empty filter", scope)
+		}
+		err := filter.validate()
+		if err != nil {
+			return fmt.Errorf("invalid responseFields for %s: %s", scope, err.Error())
+		}
+	}
+	if origin.Headers != nil {
+		err := origin.Headers.validate()
+		if err != nil {
+			return fmt.Errorf("invalid headers: %s", err.Error())
+		}
+	}
+	if origin.MaxBodyBytes < 0 {
+		return fmt.Errorf("maxBodyBytes can't be negative")
+	}
+	err := validateMethods(origin.Methods)
+	if err != nil {
+		return err
+	}
+	err = origin.compileRequestSchema()
+	if err != nil {
+		return err
+	}
+	err = origin.compileResponseSchema()
+	if err != nil {
+		return err
+	}
+	if (origin.Origin == "") == (len(origin.Origins) == 0) {
+		return fmt.Errorf("exactly one of origin and origins should be set")
+	}
+	err = validateLoadBalancing(origin.LoadBalancing)
+	if err != nil {
+		return err
+	}
+	err = origin.validateShadow()
+	if err != nil {
+		return err
+	}
+	err = validateHost(origin.Host)
+	if err != nil {
+		return err
+	}
+	for i, originUrl := range origin.originURLs() {
+		parsed, err := url.Parse(originUrl)
+		if err != nil {
+			return err
+		}
+		if parsed.Scheme == "" || parsed.Host == "" {
+			return fmt.Errorf("origin should be an absolute url")
+		}
+		//requests are balanced by changing the host
+		if first, _ := url.Parse(origin.originURLs()[0]); i > 0 && parsed.Path != first.Path {
+			return fmt.Errorf("all origins should have the same path")
+		}
+	}
+	return nil
+}
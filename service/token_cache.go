@@ -0,0 +1,235 @@
+package service
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-oauth2/oauth2/v4"
+	"github.com/jackc/pgx/v5"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// tokenInvalidationChannel is the Postgres notification channel that replicas use to
+// tell each other which cached tokens are no longer valid.
+// The payload is "token:<hash>" or "client:<client id>".
+const tokenInvalidationChannel = "oauth2_token_invalidation"
+
+var (
+	tokenCacheHits   = expvar.NewInt("token_cache_hits")
+	tokenCacheMisses = expvar.NewInt("token_cache_misses")
+)
+
+type tokenCacheEntry struct {
+	hash     string
+	clientId string
+	token    oauth2.TokenInfo
+	expires  time.Time
+}
+
+// TokenCache is a bounded LRU cache of access token lookups, keyed by a hash of the token.
+type TokenCache struct {
+	maxEntries int
+	ttl        time.Duration
+	mu         sync.Mutex
+	entries    map[string]*list.Element
+	lru        *list.List
+}
+
+func NewTokenCache(maxEntries int, ttl time.Duration) *TokenCache {
+	return &TokenCache{
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		entries:    map[string]*list.Element{},
+		lru:        list.New(),
+	}
+}
+
+func hashToken(access string) string {
+	hash := sha256.Sum256([]byte(access))
+	return hex.EncodeToString(hash[:])
+}
+
+func (c *TokenCache) get(hash string) oauth2.TokenInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, found := c.entries[hash]
+	if !found {
+		return nil
+	}
+	entry := elem.Value.(*tokenCacheEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(elem)
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	return entry.token
+}
+
+func (c *TokenCache) set(hash string, token oauth2.TokenInfo) {
+	expires := time.Now().Add(c.ttl)
+	//never outlive the token itself
+	if expiresIn := token.GetAccessExpiresIn(); expiresIn > 0 {
+		if tokenExpiry := token.GetAccessCreateAt().Add(expiresIn); tokenExpiry.Before(expires) {
+			expires = tokenExpiry
+		}
+	}
+	if !expires.After(time.Now()) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, found := c.entries[hash]; found {
+		c.remove(elem)
+	}
+	for c.lru.Len() >= c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+	c.entries[hash] = c.lru.PushFront(&tokenCacheEntry{
+		hash:     hash,
+		clientId: token.GetClientID(),
+		token:    token,
+		expires:  expires,
+	})
+}
+
+func (c *TokenCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*tokenCacheEntry)
+	delete(c.entries, entry.hash)
+}
+
+func (c *TokenCache) invalidateToken(hash string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, found := c.entries[hash]; found {
+		c.remove(elem)
+	}
+}
+
+func (c *TokenCache) invalidateClient(clientId string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, elem := range c.entries {
+		if elem.Value.(*tokenCacheEntry).clientId == clientId {
+			c.remove(elem)
+		}
+	}
+}
+
+func (c *TokenCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = map[string]*list.Element{}
+	c.lru.Init()
+}
+
+func (c *TokenCache) invalidate(payload string) {
+	switch {
+	case strings.HasPrefix(payload, "token:"):
+		c.invalidateToken(strings.TrimPrefix(payload, "token:"))
+	case strings.HasPrefix(payload, "client:"):
+		c.invalidateClient(strings.TrimPrefix(payload, "client:"))
+	}
+}
+
+// listen applies the invalidations of the other replicas.
+// Notifications can be missed while the connection is down, so the cache is cleared when it reconnects.
+func (c *TokenCache) listen(dsn string) {
+	for {
+		err := c.listenOnce(dsn)
+		logrus.Errorf("Error listening for token invalidations, reconnecting: %s", err.Error())
+		c.clear()
+		time.Sleep(5 * time.Second)
+	}
+}
+
+func (c *TokenCache) listenOnce(dsn string) error {
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, dsn)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+	_, err = conn.Exec(ctx, "LISTEN "+tokenInvalidationChannel)
+	if err != nil {
+		return err
+	}
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		c.invalidate(notification.Payload)
+	}
+}
+
+// cachedTokenStore caches the access token lookups of the token store.
+// Removing a token through the store, like refresh token rotation does, invalidates it on all replicas.
+type cachedTokenStore struct {
+	oauth2.TokenStore
+	cache *TokenCache
+	db    *gorm.DB
+}
+
+func (store *cachedTokenStore) GetByAccess(ctx context.Context, access string) (oauth2.TokenInfo, error) {
+	hash := hashToken(access)
+	if token := store.cache.get(hash); token != nil {
+		tokenCacheHits.Add(1)
+		return token, nil
+	}
+	tokenCacheMisses.Add(1)
+	token, err := store.TokenStore.GetByAccess(ctx, access)
+	if err != nil || token == nil {
+		return token, err
+	}
+	store.cache.set(hash, token)
+	return token, nil
+}
+
+func (store *cachedTokenStore) RemoveByAccess(ctx context.Context, access string) error {
+	err := store.TokenStore.RemoveByAccess(ctx, access)
+	if err != nil {
+		return err
+	}
+	store.notify(ctx, "token:"+hashToken(access))
+	return nil
+}
+
+func (store *cachedTokenStore) RemoveByRefresh(ctx context.Context, refresh string) error {
+	token, err := store.TokenStore.GetByRefresh(ctx, refresh)
+	if err != nil {
+		return err
+	}
+	err = store.TokenStore.RemoveByRefresh(ctx, refresh)
+	if err != nil {
+		return err
+	}
+	if token != nil && token.GetAccess() != "" {
+		store.notify(ctx, "token:"+hashToken(token.GetAccess()))
+	}
+	return nil
+}
+
+// notify invalidates the cache of this instance right away, and the caches of the other replicas through Postgres.
+func (store *cachedTokenStore) notify(ctx context.Context, payload string) {
+	store.cache.invalidate(payload)
+	err := store.db.WithContext(ctx).Exec("SELECT pg_notify(?, ?)", tokenInvalidationChannel, payload).Error
+	if err != nil {
+		logrus.Errorf("Error notifying token invalidation %s: %s", payload, err.Error())
+	}
+}
+
+// InvalidateClientTokens removes the cached tokens of a client on all replicas,
+// it should be called after the tokens of the client were deleted from the database.
+func (svc *Service) InvalidateClientTokens(ctx context.Context, clientId string) {
+	if svc.tokenStore == nil {
+		return
+	}
+	svc.tokenStore.notify(ctx, "client:"+clientId)
+}
@@ -0,0 +1,353 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"oauth2server/problem"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultConnectTimeout   = 10 * time.Second
+	defaultResponseTimeout  = 30 * time.Second
+	defaultRetryBackoff     = 100 * time.Millisecond
+	defaultFailureThreshold = 5
+	defaultOpenDuration     = 30 * time.Second
+)
+
+// Duration is a time.Duration that is written as a string like "1.5s" in the target file.
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return err
+	}
+	d.Duration, err = time.ParseDuration(s)
+	return err
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UpstreamConfig holds the settings for a single origin url in the target file.
+type UpstreamConfig struct {
+	//maximum time to establish a connection to the origin
+	ConnectTimeout Duration `json:"connectTimeout"`
+	//maximum time to wait for the response headers of the origin
+	ResponseTimeout Duration              `json:"responseTimeout"`
+	Retry           *RetryConfig          `json:"retry,omitempty"`
+	CircuitBreaker  *CircuitBreakerConfig `json:"circuitBreaker,omitempty"`
+	HealthCheck     *HealthCheckConfig    `json:"healthCheck,omitempty"`
+	TLS             *TLSConfig            `json:"tls,omitempty"`
+}
+
+// RetryConfig is the retry policy for GET and HEAD requests.
+// Requests are retried on connection errors and on 502, 503 and 504 responses.
+type RetryConfig struct {
+	Attempts int `json:"attempts"`
+	//the backoff grows linearly with every attempt
+	Backoff Duration `json:"backoff"`
+}
+
+type UpstreamHealth struct {
+	CircuitBreaker string `json:"circuitBreaker"`
+	Failures       int    `json:"failures"`
+	//disabled, healthy or unhealthy
+	HealthCheck string `json:"healthCheck"`
+	LastError   string `json:"lastError,omitempty"`
+	//requests that are waiting for or reading a response of the origin
+	ActiveRequests int64 `json:"activeRequests"`
+}
+
+type upstream struct {
+	origin    string
+	transport *http.Transport
+	breaker   *circuitBreaker
+	retry     *RetryConfig
+	checker   *healthChecker
+	proxy     *httputil.ReverseProxy
+	//number of active requests, for least connections balancing
+	active int64
+}
+
+type circuitOpenError struct {
+	retryAfter time.Duration
+}
+
+func (e *circuitOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker is open, retry after %s", e.retryAfter)
+}
+
+func (config *UpstreamConfig) validate() error {
+	if config.ConnectTimeout.Duration < 0 || config.ResponseTimeout.Duration < 0 {
+		return fmt.Errorf("timeouts can't be negative")
+	}
+	if config.Retry != nil && (config.Retry.Attempts < 0 || config.Retry.Backoff.Duration < 0) {
+		return fmt.Errorf("retry attempts and backoff can't be negative")
+	}
+	if config.CircuitBreaker != nil && (config.CircuitBreaker.FailureThreshold < 0 || config.CircuitBreaker.OpenDuration.Duration < 0) {
+		return fmt.Errorf("circuit breaker threshold and duration can't be negative")
+	}
+	if config.TLS != nil {
+		err := config.TLS.validate()
+		if err != nil {
+			return err
+		}
+	}
+	if config.HealthCheck != nil {
+		return config.HealthCheck.validate()
+	}
+	return nil
+}
+
+func newUpstream(origin string, config *UpstreamConfig) (*upstream, error) {
+	originUrl, err := url.Parse(origin)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		config = &UpstreamConfig{}
+	}
+	connectTimeout := config.ConnectTimeout.Duration
+	if connectTimeout == 0 {
+		connectTimeout = defaultConnectTimeout
+	}
+	responseTimeout := config.ResponseTimeout.Duration
+	if responseTimeout == 0 {
+		responseTimeout = defaultResponseTimeout
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   connectTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.ResponseHeaderTimeout = responseTimeout
+	if config.TLS != nil {
+		transport.TLSClientConfig, err = newTLSConfig(origin, config.TLS)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tls config of upstream %s: %s", origin, err.Error())
+		}
+	}
+
+	up := &upstream{
+		origin:    origin,
+		transport: transport,
+		retry:     config.Retry,
+	}
+	if config.CircuitBreaker != nil {
+		up.breaker = newCircuitBreaker(origin, config.CircuitBreaker)
+	}
+	if config.HealthCheck != nil {
+		up.checker = newHealthChecker(originUrl, config.HealthCheck, transport)
+	}
+	up.proxy = newProxy(originUrl, up, func(w http.ResponseWriter, r *http.Request, err error) {
+		handleProxyError(origin, w, r, err)
+	})
+	return up, nil
+}
+
+func newProxy(originUrl *url.URL, transport http.RoundTripper, errorHandler func(http.ResponseWriter, *http.Request, error)) *httputil.ReverseProxy {
+	proxy := httputil.NewSingleHostReverseProxy(originUrl)
+	proxy.Transport = transport
+	proxy.ErrorHandler = errorHandler
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		selectBearerSubprotocol(resp)
+		return filterResponse(resp)
+	}
+	return proxy
+}
+
+func (up *upstream) health() UpstreamHealth {
+	health := UpstreamHealth{CircuitBreaker: "disabled", HealthCheck: "disabled"}
+	if up.breaker != nil {
+		health = up.breaker.health()
+	}
+	if up.checker != nil {
+		health.HealthCheck, health.LastError = up.checker.status()
+	}
+	health.ActiveRequests = atomic.LoadInt64(&up.active)
+	return health
+}
+
+// available is false when the origin should not get requests, because a health check or the circuit breaker says it is down.
+func (up *upstream) available() bool {
+	if up.checker != nil && !up.checker.isHealthy() {
+		return false
+	}
+	return up.breaker == nil || up.breaker.available()
+}
+
+// start starts the active health checks, it is called once the upstream is used by the gateway.
+func (up *upstream) start() {
+	if up.checker != nil {
+		go up.checker.run()
+	}
+}
+
+// close stops the health checks and closes the idle connections, after the upstream has been replaced by a reload.
+// In flight requests are not affected, their connections are not idle.
+func (up *upstream) close() {
+	if up.checker != nil {
+		up.checker.stop()
+	}
+	up.transport.CloseIdleConnections()
+}
+
+// RoundTrip sends the request to the origin, retrying idempotent requests if configured.
+// The request counts as active until the response body is closed.
+func (up *upstream) RoundTrip(r *http.Request) (*http.Response, error) {
+	return up.trackActive(r, up.roundTripWithRetries)
+}
+
+// trackActive counts the request as active until the response body is closed.
+func (up *upstream) trackActive(r *http.Request, roundTrip func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	atomic.AddInt64(&up.active, 1)
+	resp, err := roundTrip(r)
+	if err != nil {
+		atomic.AddInt64(&up.active, -1)
+		return resp, err
+	}
+	done := func() { atomic.AddInt64(&up.active, -1) }
+	//upgraded connections need a writable body
+	if body, ok := resp.Body.(io.ReadWriteCloser); ok && resp.StatusCode == http.StatusSwitchingProtocols {
+		resp.Body = &activeReadWriteBody{ReadWriteCloser: body, done: done}
+	} else {
+		resp.Body = &activeBody{ReadCloser: resp.Body, done: done}
+	}
+	return resp, nil
+}
+
+type activeBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *activeBody) Close() error {
+	b.once.Do(b.done)
+	return b.ReadCloser.Close()
+}
+
+type activeReadWriteBody struct {
+	io.ReadWriteCloser
+	once sync.Once
+	done func()
+}
+
+func (b *activeReadWriteBody) Close() error {
+	b.once.Do(b.done)
+	return b.ReadWriteCloser.Close()
+}
+
+func (up *upstream) roundTripWithRetries(r *http.Request) (*http.Response, error) {
+	attempts := 1
+	if up.retry != nil && isRetryable(r) {
+		attempts += up.retry.Attempts
+	}
+	for attempt := 1; ; attempt++ {
+		resp, err := up.roundTrip(r)
+		if attempt >= attempts || !isUpstreamFailure(r, resp, err) {
+			return resp, err
+		}
+		var openErr *circuitOpenError
+		if errors.As(err, &openErr) || (up.breaker != nil && up.breaker.isOpen()) {
+			return resp, err
+		}
+		if resp != nil {
+			//discard the response, we are going to make another one
+			_, _ = io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		logrus.WithField("origin", up.origin).Warnf("Retrying %s %s after failed attempt %d", r.Method, r.URL.Path, attempt)
+		select {
+		case <-time.After(up.retry.backoff() * time.Duration(attempt)):
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
+		}
+	}
+}
+
+func (up *upstream) roundTrip(r *http.Request) (*http.Response, error) {
+	if up.breaker == nil {
+		return up.transport.RoundTrip(r)
+	}
+	return up.breaker.roundTrip(r, up.transport.RoundTrip)
+}
+
+// isRetryable is true for the requests that can be sent again: GET and HEAD requests without body.
+func isRetryable(r *http.Request) bool {
+	return (r.Method == http.MethodGet || r.Method == http.MethodHead) && r.Body == nil
+}
+
+func (retry *RetryConfig) backoff() time.Duration {
+	if retry.Backoff.Duration == 0 {
+		return defaultRetryBackoff
+	}
+	return retry.Backoff.Duration
+}
+
+func isUpstreamFailure(r *http.Request, resp *http.Response, err error) bool {
+	if err != nil {
+		return r.Context().Err() == nil
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// requestNotSent reports whether the request failed before it was sent to the origin.
+// After a timeout, or an error once the request was written, the origin may have processed it.
+func requestNotSent(err error) bool {
+	var openErr *circuitOpenError
+	var opErr *net.OpError
+	return errors.Is(err, errNoAvailableOrigin) || errors.As(err, &openErr) || (errors.As(err, &opErr) && opErr.Op == "dial")
+}
+
+func handleProxyError(origin string, w http.ResponseWriter, r *http.Request, err error) {
+	if rec, ok := w.(*idempotencyRecorder); ok && requestNotSent(err) {
+		//the origin never got the request, so a retry with the same key has to reach it
+		rec.notSent = true
+	}
+	var openErr *circuitOpenError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errNoAvailableOrigin):
+		logrus.WithField("origin", origin).Errorf("No available origin for %s %s", r.Method, r.URL.Path)
+		writeErrorResponse(w, r, http.StatusServiceUnavailable, problem.CodeServiceUnavailable, "Service temporarily unavailable, please try again later.")
+	case errors.As(err, &openErr):
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(openErr.retryAfter.Seconds()))))
+		writeErrorResponse(w, r, http.StatusServiceUnavailable, problem.CodeServiceUnavailable, "Service temporarily unavailable, please try again later.")
+	case errors.Is(err, context.Canceled):
+		//the client went away, nobody will read this
+		w.WriteHeader(http.StatusBadGateway)
+	case errors.As(err, &netErr) && netErr.Timeout():
+		logrus.WithField("origin", origin).Errorf("Timeout proxying %s %s: %s", r.Method, r.URL.Path, err.Error())
+		writeErrorResponse(w, r, http.StatusGatewayTimeout, problem.CodeUpstreamTimeout, "The upstream service did not respond in time.")
+	default:
+		logrus.WithField("origin", origin).Errorf("Error proxying %s %s: %s", r.Method, r.URL.Path, err.Error())
+		sentry.CaptureException(err)
+		writeErrorResponse(w, r, http.StatusBadGateway, problem.CodeUpstreamError, "Something went wrong while contacting the upstream service.")
+	}
+}
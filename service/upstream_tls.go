@@ -0,0 +1,166 @@
+package service
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSConfig holds the TLS settings for the connections to an origin.
+type TLSConfig struct {
+	//PEM file with the certificate authorities that are trusted instead of the system ones
+	CAFile string `json:"caFile,omitempty"`
+	//PEM files of the client certificate and key, for origins that require mutual TLS
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+	//name that is sent as SNI and checked against the certificate of the origin, the host of the origin by default
+	ServerName string `json:"serverName,omitempty"`
+	//1.0, 1.1, 1.2 or 1.3
+	MinVersion string `json:"minVersion,omitempty"`
+}
+
+func (config *TLSConfig) validate() error {
+	if (config.CertFile == "") != (config.KeyFile == "") {
+		return fmt.Errorf("tls: certFile and keyFile have to be set together")
+	}
+	if _, found := tlsVersions[config.MinVersion]; config.MinVersion != "" && !found {
+		return fmt.Errorf("tls: unknown minVersion %s", config.MinVersion)
+	}
+	return nil
+}
+
+// tlsFiles holds the CA bundle and client certificate of an origin.
+// The files are read again when they change on disk, so certificates can be rotated without a reload.
+type tlsFiles struct {
+	config *TLSConfig
+	mu     sync.Mutex
+	//modification times of the files that were loaded
+	modTimes map[string]time.Time
+	roots    *x509.CertPool
+	cert     *tls.Certificate
+}
+
+// newTLSConfig returns the client TLS config for an origin,
+// the files are loaded right away so a reload with missing or invalid files fails.
+func newTLSConfig(origin string, config *TLSConfig) (*tls.Config, error) {
+	files := &tlsFiles{config: config, modTimes: map[string]time.Time{}}
+	err := files.load()
+	if err != nil {
+		return nil, err
+	}
+	result := &tls.Config{
+		ServerName: config.ServerName,
+		MinVersion: tlsVersions[config.MinVersion],
+	}
+	if config.CAFile != "" {
+		//the default verification can't use a pool that changes, so the certificate chain is verified here
+		result.InsecureSkipVerify = true
+		result.VerifyConnection = func(cs tls.ConnectionState) error {
+			roots := files.currentRoots(origin)
+			if len(cs.PeerCertificates) == 0 {
+				return fmt.Errorf("origin did not send a certificate")
+			}
+			opts := x509.VerifyOptions{
+				DNSName:       cs.ServerName,
+				Roots:         roots,
+				Intermediates: x509.NewCertPool(),
+			}
+			for _, cert := range cs.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			_, err := cs.PeerCertificates[0].Verify(opts)
+			return err
+		}
+	}
+	if config.CertFile != "" {
+		result.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return files.currentCert(origin), nil
+		}
+	}
+	return result, nil
+}
+
+func (files *tlsFiles) currentRoots(origin string) *x509.CertPool {
+	files.reload(origin)
+	files.mu.Lock()
+	defer files.mu.Unlock()
+	return files.roots
+}
+
+func (files *tlsFiles) currentCert(origin string) *tls.Certificate {
+	files.reload(origin)
+	files.mu.Lock()
+	defer files.mu.Unlock()
+	return files.cert
+}
+
+// reload loads the files again if one of them changed.
+// The old certificates are kept if the new ones can't be loaded, eg. because the key is not written yet.
+func (files *tlsFiles) reload(origin string) {
+	err := files.load()
+	if err != nil {
+		logrus.WithField("origin", origin).Errorf("Error reloading tls files, keeping the previous ones: %s", err.Error())
+	}
+}
+
+func (files *tlsFiles) load() error {
+	modTimes := map[string]time.Time{}
+	changed := false
+	files.mu.Lock()
+	for _, file := range []string{files.config.CAFile, files.config.CertFile, files.config.KeyFile} {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			files.mu.Unlock()
+			return err
+		}
+		modTimes[file] = info.ModTime()
+		if !info.ModTime().Equal(files.modTimes[file]) {
+			changed = true
+		}
+	}
+	files.mu.Unlock()
+	if !changed {
+		return nil
+	}
+	var roots *x509.CertPool
+	if files.config.CAFile != "" {
+		pem, err := ioutil.ReadFile(files.config.CAFile)
+		if err != nil {
+			return err
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", files.config.CAFile)
+		}
+	}
+	var cert *tls.Certificate
+	if files.config.CertFile != "" {
+		pair, err := tls.LoadX509KeyPair(files.config.CertFile, files.config.KeyFile)
+		if err != nil {
+			return err
+		}
+		cert = &pair
+	}
+	files.mu.Lock()
+	defer files.mu.Unlock()
+	files.roots = roots
+	files.cert = cert
+	files.modTimes = modTimes
+	return nil
+}
@@ -0,0 +1,110 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"oauth2server/problem"
+	"sort"
+	"strconv"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// compileRequestSchema compiles the requestSchema of the target.
+func (origin *OriginServer) compileRequestSchema() error {
+	if len(origin.RequestSchema) == 0 {
+		return nil
+	}
+	compiler := jsonschema.NewCompiler()
+	err := compiler.AddResource("requestSchema.json", bytes.NewReader(origin.RequestSchema))
+	if err != nil {
+		return fmt.Errorf("invalid requestSchema: %s", err.Error())
+	}
+	origin.requestSchema, err = compiler.Compile("requestSchema.json")
+	if err != nil {
+		return fmt.Errorf("invalid requestSchema: %s", err.Error())
+	}
+	return nil
+}
+
+// hasBody returns true for the methods the request schema applies to.
+func hasBody(r *http.Request) bool {
+	return r.Method == http.MethodPost || r.Method == http.MethodPut || r.Method == http.MethodPatch
+}
+
+// validateRequestBody checks the size of the request body and validates it against the request schema.
+// The body is read completely and replaced, so it can still be proxied.
+// It writes the error response and returns false if the request is invalid.
+func (origin *OriginServer) validateRequestBody(w http.ResponseWriter, r *http.Request) bool {
+	if origin.MaxBodyBytes == 0 && (origin.requestSchema == nil || !hasBody(r)) {
+		return true
+	}
+	if origin.MaxBodyBytes > 0 && r.ContentLength > origin.MaxBodyBytes {
+		writeErrorResponse(w, r, http.StatusRequestEntityTooLarge, problem.CodeRequestTooLarge, "The request body is too large.")
+		return false
+	}
+	reader := io.Reader(r.Body)
+	if origin.MaxBodyBytes > 0 {
+		reader = io.LimitReader(r.Body, origin.MaxBodyBytes+1)
+	}
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Error reading the request body.")
+		return false
+	}
+	r.Body.Close()
+	if origin.MaxBodyBytes > 0 && int64(len(body)) > origin.MaxBodyBytes {
+		writeErrorResponse(w, r, http.StatusRequestEntityTooLarge, problem.CodeRequestTooLarge, "The request body is too large.")
+		return false
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	if r.Header.Get("Content-Length") != "" {
+		r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	if origin.requestSchema == nil || !hasBody(r) {
+		return true
+	}
+	var doc interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	//numbers are validated exactly, not as float64
+	decoder.UseNumber()
+	err = decoder.Decode(&doc)
+	if err == nil && decoder.More() {
+		err = fmt.Errorf("unexpected data after the JSON value")
+	}
+	if err != nil {
+		problem.Write(w, r, problem.Invalid(problem.FieldError{Error: "request body is not valid JSON"}))
+		return false
+	}
+	err = origin.requestSchema.Validate(doc)
+	if err != nil {
+		fields := []problem.FieldError{{Error: err.Error()}}
+		var validationErr *jsonschema.ValidationError
+		if errors.As(err, &validationErr) {
+			fields = fieldErrors(validationErr)
+		}
+		problem.Write(w, r, problem.Invalid(fields...))
+		return false
+	}
+	return true
+}
+
+// fieldErrors returns the innermost errors, they point to the fields that failed.
+func fieldErrors(err *jsonschema.ValidationError) []problem.FieldError {
+	if len(err.Causes) == 0 {
+		return []problem.FieldError{{Field: err.InstanceLocation, Error: err.Message}}
+	}
+	result := []problem.FieldError{}
+	for _, cause := range err.Causes {
+		result = append(result, fieldErrors(cause)...)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Field < result[j].Field
+	})
+	return result
+}
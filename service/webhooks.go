@@ -0,0 +1,425 @@
+package service
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"oauth2server/constants"
+	"oauth2server/models"
+	"oauth2server/problem"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	oauth2gorm "github.com/getAlby/go-oauth2-gorm"
+	"github.com/labstack/gommon/random"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// EventGrantRevoked is sent by the server itself to a client when a user disconnects it.
+	EventGrantRevoked = "grant.revoked"
+
+	WebhookStatusPending   = "pending"
+	WebhookStatusDelivered = "delivered"
+	WebhookStatusFailed    = "failed"
+
+	webhookSecretLength  = 32
+	webhookMaxAttempts   = 10
+	webhookBaseBackoff   = 30 * time.Second
+	webhookMaxBackoff    = 6 * time.Hour
+	webhookTimeout       = 10 * time.Second
+	webhookBatchSize     = 20
+	webhookPollInterval  = 5 * time.Second
+	webhookDeliveryLease = time.Minute
+	//delivered and failed deliveries are kept this long
+	webhookDeliveryRetention = 30 * 24 * time.Hour
+)
+
+// claimDeliveriesQuery takes the deliveries that are due, and pushes their next attempt back
+// so other instances don't pick them up while they are being sent.
+const claimDeliveriesQuery = `
+UPDATE webhook_deliveries SET next_attempt_at = @lease
+WHERE id IN (
+	SELECT id FROM webhook_deliveries
+	WHERE status = 'pending' AND next_attempt_at <= @now
+	ORDER BY next_attempt_at
+	LIMIT @limit
+	FOR UPDATE SKIP LOCKED
+)
+RETURNING *`
+
+type webhookPayload struct {
+	ID      string          `json:"id"`
+	Type    string          `json:"type"`
+	Created int64           `json:"created"`
+	UserID  string          `json:"userId"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// WebhookEvents returns the event types clients can subscribe to, with the scope a user has to grant for each.
+func (svc *Service) WebhookEvents() map[string]string {
+	result := map[string]string{EventGrantRevoked: ""}
+	state := svc.currentGateway()
+	if state == nil {
+		return result
+	}
+	for event, scope := range state.webhookEvents {
+		result[event] = scope
+	}
+	return result
+}
+
+func validateWebhookEvents(events map[string]string, scopes map[string]string) error {
+	for event, scope := range events {
+		if event == EventGrantRevoked {
+			return fmt.Errorf("webhook event %s is sent by the server itself", event)
+		}
+		if _, found := scopes[scope]; !found {
+			return fmt.Errorf("webhook event %s needs scope %s, which is not the scope of any target", event, scope)
+		}
+	}
+	return nil
+}
+
+// CreateWebhookEndpoint registers an url of the client, the returned endpoint contains the signing secret.
+func (svc *Service) CreateWebhookEndpoint(ctx context.Context, clientId string, req *models.CreateWebhookRequest) (*models.WebhookEndpoint, error) {
+	parsed, err := url.Parse(req.URL)
+	if err != nil || parsed.Host == "" || (parsed.Scheme != "https" && !(svc.Config.WebhookAllowInsecure && parsed.Scheme == "http")) {
+		return nil, problem.Invalid(problem.FieldError{Field: "url", Error: "should be an absolute https url"})
+	}
+	events := svc.WebhookEvents()
+	for _, event := range req.Events {
+		if _, found := events[event]; !found {
+			return nil, problem.Invalid(problem.FieldError{Field: "events", Error: fmt.Sprintf("unknown event type %s", event)})
+		}
+	}
+	endpoint := &models.WebhookEndpoint{
+		ClientID:   clientId,
+		URL:        req.URL,
+		EventTypes: req.Events,
+		Secret:     random.New().String(webhookSecretLength, random.Alphanumeric),
+	}
+	err = svc.DB.WithContext(ctx).Create(endpoint).Error
+	if err != nil {
+		return nil, err
+	}
+	return endpoint, nil
+}
+
+// WebhookEndpoints returns the endpoints of a client, without their secrets.
+func (svc *Service) WebhookEndpoints(ctx context.Context, clientId string) ([]models.WebhookEndpoint, error) {
+	result := []models.WebhookEndpoint{}
+	err := svc.DB.WithContext(ctx).Where("client_id = ?", clientId).Order("id").Find(&result).Error
+	if err != nil {
+		return nil, err
+	}
+	for i := range result {
+		result[i].Secret = ""
+	}
+	return result, nil
+}
+
+// DeleteWebhookEndpoint removes an endpoint of the client and its delivery log.
+// It returns false if the client has no endpoint with this id.
+func (svc *Service) DeleteWebhookEndpoint(ctx context.Context, clientId string, id uint) (found bool, err error) {
+	result := svc.DB.WithContext(ctx).Where("id = ? AND client_id = ?", id, clientId).Delete(&models.WebhookEndpoint{})
+	if result.Error != nil || result.RowsAffected == 0 {
+		return false, result.Error
+	}
+	return true, svc.DB.WithContext(ctx).Where("endpoint_id = ?", id).Delete(&models.WebhookDelivery{}).Error
+}
+
+// WebhookDeliveries returns the latest deliveries to an endpoint of the client.
+func (svc *Service) WebhookDeliveries(ctx context.Context, clientId string, id uint, limit int) (result []models.WebhookDelivery, found bool, err error) {
+	endpoint := []models.WebhookEndpoint{}
+	err = svc.DB.WithContext(ctx).Where("id = ? AND client_id = ?", id, clientId).Find(&endpoint).Error
+	if err != nil || len(endpoint) == 0 {
+		return nil, false, err
+	}
+	result = []models.WebhookDelivery{}
+	err = svc.DB.WithContext(ctx).Where("endpoint_id = ?", id).Order("id desc").Limit(limit).Find(&result).Error
+	return result, true, err
+}
+
+// IngestEvent queues the event for the endpoints of all clients that the user granted the scope of the event to.
+func (svc *Service) IngestEvent(ctx context.Context, event *models.WebhookEvent) (deliveries int, err error) {
+	scope, found := svc.WebhookEvents()[event.Type]
+	if !found || event.Type == EventGrantRevoked {
+		return 0, fmt.Errorf("unknown event type %s", event.Type)
+	}
+	grants := []oauth2gorm.TokenStoreItem{}
+	err = svc.DB.WithContext(ctx).Table(constants.TokenTableName).
+		Where("user_id = ? AND expires_at > ?", event.UserID, time.Now()).
+		Find(&grants).Error
+	if err != nil {
+		return 0, err
+	}
+	clientIds := map[string]bool{}
+	for _, grant := range grants {
+		if svc.ScopeAllowed(grant.Scope, scope) {
+			clientIds[grant.ClientID] = true
+		}
+	}
+	return svc.queueEvent(ctx, event, clientIds)
+}
+
+// EmitEvent queues an event of the server itself for a single client.
+func (svc *Service) EmitEvent(ctx context.Context, clientId string, event *models.WebhookEvent) error {
+	_, err := svc.queueEvent(ctx, event, map[string]bool{clientId: true})
+	return err
+}
+
+func (svc *Service) queueEvent(ctx context.Context, event *models.WebhookEvent, clientIds map[string]bool) (deliveries int, err error) {
+	if len(clientIds) == 0 {
+		return 0, nil
+	}
+	if event.ID == "" {
+		event.ID = random.New().String(32, random.Alphanumeric)
+	}
+	ids := []string{}
+	for id := range clientIds {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	endpoints := []models.WebhookEndpoint{}
+	err = svc.DB.WithContext(ctx).Where("client_id IN ?", ids).Find(&endpoints).Error
+	if err != nil {
+		return 0, err
+	}
+	payload, err := json.Marshal(&webhookPayload{
+		ID:      event.ID,
+		Type:    event.Type,
+		Created: time.Now().Unix(),
+		UserID:  event.UserID,
+		Data:    event.Data,
+	})
+	if err != nil {
+		return 0, err
+	}
+	rows := []models.WebhookDelivery{}
+	for _, endpoint := range endpoints {
+		if !containsString(endpoint.EventTypes, event.Type) {
+			continue
+		}
+		rows = append(rows, models.WebhookDelivery{
+			EndpointID:    endpoint.ID,
+			EventID:       event.ID,
+			EventType:     event.Type,
+			Payload:       string(payload),
+			Status:        WebhookStatusPending,
+			NextAttemptAt: time.Now(),
+		})
+	}
+	if len(rows) == 0 {
+		return 0, nil
+	}
+	//an event that is ingested again is not delivered twice
+	result := svc.DB.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(&rows)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	svc.wakeWebhookWorker()
+	return int(result.RowsAffected), nil
+}
+
+func (svc *Service) wakeWebhookWorker() {
+	select {
+	case svc.webhookWake <- struct{}{}:
+	default:
+	}
+}
+
+// DeliverWebhooks blocks and sends the deliveries that are due.
+// It can run on every instance, a delivery is only sent by one of them at a time.
+func (svc *Service) DeliverWebhooks() {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	//a proxy would connect to the endpoint without the address check
+	transport.Proxy = nil
+	if !svc.Config.WebhookAllowInsecure {
+		dialer := &net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+			Control:   checkWebhookAddress,
+		}
+		transport.DialContext = dialer.DialContext
+	}
+	client := &http.Client{
+		Timeout:   webhookTimeout,
+		Transport: transport,
+		//a redirect is not a successful delivery
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+	lastCleanup := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+		case <-svc.webhookWake:
+		}
+		for {
+			deliveries, err := svc.claimDeliveries()
+			if err != nil {
+				logrus.Errorf("Error loading webhook deliveries: %s", err.Error())
+				break
+			}
+			for i := range deliveries {
+				svc.deliverWebhook(client, &deliveries[i])
+			}
+			if len(deliveries) < webhookBatchSize {
+				break
+			}
+		}
+		if time.Since(lastCleanup) > time.Hour {
+			lastCleanup = time.Now()
+			err := svc.DB.Where("status <> ? AND created_at < ?", WebhookStatusPending, time.Now().Add(-webhookDeliveryRetention)).Delete(&models.WebhookDelivery{}).Error
+			if err != nil {
+				logrus.Errorf("Error removing old webhook deliveries: %s", err.Error())
+			}
+		}
+	}
+}
+
+func (svc *Service) claimDeliveries() (result []models.WebhookDelivery, err error) {
+	now := time.Now()
+	result = []models.WebhookDelivery{}
+	err = svc.DB.Raw(claimDeliveriesQuery, map[string]interface{}{
+		"lease": now.Add(webhookDeliveryLease),
+		"now":   now,
+		"limit": webhookBatchSize,
+	}).Scan(&result).Error
+	return result, err
+}
+
+func (svc *Service) deliverWebhook(client *http.Client, delivery *models.WebhookDelivery) {
+	endpoint := &models.WebhookEndpoint{}
+	err := svc.DB.First(endpoint, delivery.EndpointID).Error
+	if err != nil {
+		logrus.Errorf("Error loading webhook endpoint %d: %s", delivery.EndpointID, err.Error())
+		return
+	}
+	delivery.Attempts++
+	statusCode, err := sendWebhook(client, endpoint, delivery)
+	entry := logrus.WithField("webhook_endpoint", endpoint.ID).
+		WithField("client_id", endpoint.ClientID).
+		WithField("event_id", delivery.EventID).
+		WithField("event", delivery.EventType).
+		WithField("attempt", delivery.Attempts).
+		WithField("status", statusCode)
+	delivery.LastStatusCode = statusCode
+	delivery.LastError = ""
+	switch {
+	case err == nil:
+		now := time.Now()
+		delivery.Status = WebhookStatusDelivered
+		delivery.DeliveredAt = &now
+		entry.Info("Webhook delivered")
+	case delivery.Attempts >= webhookMaxAttempts:
+		delivery.Status = WebhookStatusFailed
+		delivery.LastError = err.Error()
+		entry.Warnf("Webhook delivery failed, giving up: %s", err.Error())
+	default:
+		delivery.LastError = err.Error()
+		delivery.NextAttemptAt = time.Now().Add(webhookBackoff(delivery.Attempts))
+		entry.Warnf("Webhook delivery failed, retrying at %s: %s", delivery.NextAttemptAt.Format(time.RFC3339), err.Error())
+	}
+	err = svc.DB.Save(delivery).Error
+	if err != nil {
+		logrus.Errorf("Error storing webhook delivery %d: %s", delivery.ID, err.Error())
+	}
+}
+
+// webhookBackoff doubles the wait time after every failed attempt.
+func webhookBackoff(attempts int) time.Duration {
+	backoff := time.Duration(float64(webhookBaseBackoff) * math.Pow(2, float64(attempts-1)))
+	if backoff > webhookMaxBackoff {
+		return webhookMaxBackoff
+	}
+	return backoff
+}
+
+func sendWebhook(client *http.Client, endpoint *models.WebhookEndpoint, delivery *models.WebhookDelivery) (statusCode int, err error) {
+	req, err := http.NewRequest(http.MethodPost, endpoint.URL, strings.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "oauth2server-webhooks")
+	req.Header.Set("X-Webhook-Id", delivery.EventID)
+	req.Header.Set("X-Webhook-Event", delivery.EventType)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", SignWebhook(endpoint.Secret, timestamp, []byte(delivery.Payload)))
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// nonPublicNetworks are refused for webhooks next to the loopback, private, link-local and multicast addresses,
+// the shared address space of carrier-grade NAT and "this network".
+var nonPublicNetworks = []*net.IPNet{
+	{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)},
+	{IP: net.IPv4(0, 0, 0, 0), Mask: net.CIDRMask(8, 32)},
+}
+
+// checkWebhookAddress is called with the resolved address of every connection to a webhook endpoint,
+// it refuses addresses that are not public, so webhooks can't be used to reach internal services.
+func checkWebhookAddress(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("invalid webhook address %s", address)
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return fmt.Errorf("webhook address %s is not public", ip)
+	}
+	for _, ipNet := range nonPublicNetworks {
+		if ipNet.Contains(ip) {
+			return fmt.Errorf("webhook address %s is not public", ip)
+		}
+	}
+	return nil
+}
+
+// SignWebhook returns the hex encoded HMAC-SHA256 of the timestamp and the body, joined by a dot.
+func SignWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}